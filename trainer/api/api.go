@@ -20,35 +20,107 @@ package api
 
 import (
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
-	"fmt"
 	"encoding/json"
 	"gatoor/orca/trainer/configuration"
 	"gatoor/orca/trainer/model"
 	"gatoor/orca/trainer/state"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/planner"
+	"gatoor/orca/trainer/auth"
+	"gatoor/orca/trainer/loadbalancer"
+	"gatoor/orca/trainer/secrets"
+	"gatoor/orca/trainer/cloud"
 	log "gatoor/orca/util/log"
 )
 
 type Api struct {
 	configurationStore *configuration.ConfigurationStore
 	state              *state.StateStore
+	planner            planner.Planner
+	controller         *planner.Controller
+	authenticator      *auth.Authenticator
+	loadBalancers      *loadbalancer.Generator
+	secrets            *secrets.SecretStore
+	cloudProvider      *cloud.CloudProvider
+
+	tlsCertFile        string
+	tlsKeyFile         string
+	/* Set when host agents authenticate with client certificates */
+	certificateAuthority *auth.CertificateAuthority
+}
+
+type PlanPreview struct {
+	/* The real planner would not act on the changes until these are resolved */
+	PendingChanges bool
+	Changes        []planner.PlanningChange
 }
 
 var ApiLogger = log.LoggerWithField(log.Logger, "module", "api")
 
-func (api *Api) Init(port int, configurationStore *configuration.ConfigurationStore, state *state.StateStore) {
+/* Has to be called before Init, ca is optional and enables mutual TLS for the host agents */
+func (api *Api) ConfigureTls(certFile string, keyFile string, ca *auth.CertificateAuthority) {
+	api.tlsCertFile = certFile
+	api.tlsKeyFile = keyFile
+	api.certificateAuthority = ca
+}
+
+/* Has to be called before Init */
+func (api *Api) ConfigureLoadBalancers(generator *loadbalancer.Generator) {
+	api.loadBalancers = generator
+}
+
+/* Has to be called before Init, the plan preview looks at its pending changes */
+func (api *Api) ConfigureCloudProvider(provider *cloud.CloudProvider) {
+	api.cloudProvider = provider
+}
+
+/* Has to be called before Init */
+func (api *Api) ConfigureSecrets(store *secrets.SecretStore) {
+	api.secrets = store
+}
+
+func (api *Api) Init(listenAddress string, configurationStore *configuration.ConfigurationStore, state *state.StateStore, plannerEngine planner.Planner, controller *planner.Controller, authenticator *auth.Authenticator) {
 	api.configurationStore = configurationStore
 	api.state = state
-	ApiLogger.Infof("Initializing Api on Port %d", port)
+	api.planner = plannerEngine
+	api.controller = controller
+	api.authenticator = authenticator
+	ApiLogger.Infof("Initializing Api on %s", listenAddress)
 
 	r := mux.NewRouter()
+	r.Use(api.authenticate)
 
 	/* Routes for the client */
-	r.HandleFunc("/config", api.getAllConfiguration)
-	r.HandleFunc("/config/applications", api.getAllConfigurationApplications)
-	r.HandleFunc("/config/applications/configuration/latest", api.getAllConfigurationApplications_Configurations_Latest)
+	r.HandleFunc("/config", api.withConfiguration(api.getAllConfiguration))
+	r.HandleFunc("/config/applications", api.withConfiguration(api.getAllConfigurationApplications))
+	r.HandleFunc("/config/snapshots", api.withConfiguration(api.listSnapshots)).Methods("GET")
+	r.HandleFunc("/config/snapshots/{id}", api.withConfiguration(api.getSnapshot)).Methods("GET")
+	r.HandleFunc("/config/snapshots/{id}/restore", api.withConfiguration(api.restoreSnapshot)).Methods("POST")
+	r.HandleFunc("/config/applications/configuration/latest", api.withConfiguration(api.getAllConfigurationApplications_Configurations_Latest))
 	r.HandleFunc("/state", api.getAllRunningState)
 	r.HandleFunc("/checkin", api.hostCheckin)
+	r.HandleFunc("/plan/preview", api.withConfiguration(api.previewPlan))
+	r.HandleFunc("/planner/mode", api.plannerMode)
+	r.HandleFunc("/planner/proposals", api.getProposals)
+	r.HandleFunc("/planner/proposals/{id}", api.getProposal)
+	r.HandleFunc("/planner/proposals/{id}/approve", api.approveProposal).Methods("POST")
+	r.HandleFunc("/planner/proposals/{id}/reject", api.rejectProposal).Methods("POST")
+
+	api.initApplicationRoutes(r)
+
+	r.HandleFunc("/events", api.streamEvents).Methods("GET")
+	r.HandleFunc("/hosts/{id}/labels", api.getHostLabels).Methods("GET")
+	r.HandleFunc("/hosts/{id}/labels", api.putHostLabels).Methods("PUT")
+	r.HandleFunc("/loadbalancers", api.listLoadBalancers).Methods("GET")
+	r.HandleFunc("/loadbalancers/{name}", api.getLoadBalancer).Methods("GET")
+	r.HandleFunc("/secrets", api.listSecrets).Methods("GET")
+	r.HandleFunc("/secrets/{name}", api.getSecret).Methods("GET")
+	r.HandleFunc("/secrets/{name}", api.putSecret).Methods("PUT")
+	r.HandleFunc("/secrets/{name}", api.withConfiguration(api.deleteSecret)).Methods("DELETE")
+	r.HandleFunc("/metrics", api.getMetrics).Methods("GET")
+	r.HandleFunc("/metrics/history", api.getMetricsHistory).Methods("GET")
 
 	r.HandleFunc("/audit", api.getAudit)
 	r.HandleFunc("/audit/application", api.getAuditApplication)
@@ -56,26 +128,71 @@ func (api *Api) Init(port int, configurationStore *configuration.ConfigurationSt
 	http.Handle("/", r)
 
 	func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+		var err error
+		if api.tlsCertFile != "" {
+			server := &http.Server{Addr: listenAddress}
+			if api.certificateAuthority != nil {
+				server.TLSConfig = api.certificateAuthority.ServerTlsConfig()
+			}
+			err = server.ListenAndServeTLS(api.tlsCertFile, api.tlsKeyFile)
+		} else {
+			err = http.ListenAndServe(listenAddress, nil)
+		}
 		if err != nil {
 			ApiLogger.Fatalf("Api failed to start - %s", err)
 		}
 	}()
 }
 
+/* Reads hold the configuration lock for the request, changes until they are saved. A reload in between would
+   otherwise swap in new objects and the change would be lost */
+func (api *Api) withConfiguration(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			api.configurationStore.ReadLock()
+			defer api.configurationStore.ReadUnlock()
+		} else {
+			api.configurationStore.WriteLock()
+			defer api.configurationStore.WriteUnlock()
+		}
+		handler(w, r)
+	}
+}
+
+type ApiError struct {
+	Status int
+	Error  string
+	/* Only for validation errors */
+	Fields []configuration.FieldError `json:",omitempty"`
+}
+
 func returnJson(w http.ResponseWriter, obj interface{}) {
-	fmt.Printf("%+v", obj)
+	returnJsonWithStatus(w, http.StatusOK, obj)
+}
 
+func returnJsonWithStatus(w http.ResponseWriter, status int, obj interface{}) {
 	j, err := json.MarshalIndent(obj, "", "  ")
 	if err != nil {
 		ApiLogger.Errorf("Json serialization failed - %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(j)
 }
 
+func returnError(w http.ResponseWriter, status int, message string) {
+	j, _ := json.MarshalIndent(ApiError{Status: status, Error: message}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+func returnValidationErrors(w http.ResponseWriter, message string, errs configuration.ValidationErrors) {
+	returnJsonWithStatus(w, http.StatusBadRequest, ApiError{Status: http.StatusBadRequest, Error: message + " - " + errs.Error(), Fields: errs})
+}
+
 func (api *Api) getAllConfiguration(w http.ResponseWriter, r *http.Request) {
 	returnJson(w, api.configurationStore.GetAllConfiguration())
 }
@@ -88,19 +205,32 @@ func (api *Api) getAllConfigurationApplications(w http.ResponseWriter, r *http.R
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&object); err == nil {
 			application, err := api.configurationStore.GetConfiguration(applicationName)
+			candidate := object
+			candidate.Config = make(map[string]model.VersionConfig)
+			if err == nil {
+				candidate = *application
+				candidate.MinDeployment = object.MinDeployment
+				candidate.DesiredDeployment = object.DesiredDeployment
+			}
+			if !api.validApplication(w, applicationName, &candidate) {
+				return
+			}
 			if err != nil {
 				object.Config = make(map[string]model.VersionConfig)
-				application = api.configurationStore.Add(applicationName, &object)
+				application = api.configurationStore.Add(applicationName, &object, actor(r))
 			}
 
-			state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+			state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor(r), Details:map[string]string{
 				"message": "Modified application " + applicationName + " in pool",
 				"application": applicationName,
 			}})
 
 			application.MinDeployment = object.MinDeployment
 			application.DesiredDeployment = object.DesiredDeployment
-			api.configurationStore.Save()
+			events.PlanningTrigger.Fire("application " + applicationName + " modified")
+			if !api.saveConfiguration(w) {
+				return
+			}
 		}
 
 	}
@@ -122,14 +252,20 @@ func (api *Api) getAllConfigurationApplications_Configurations_Latest(w http.Res
 			if err := decoder.Decode(&object); err == nil {
 				newVersion := application.GetNextVersion()
 				object.Version = newVersion
+				if !api.validVersion(w, object) {
+					return
+				}
 				application.Config[newVersion] = object
 
-				state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+				state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor(r), Details:map[string]string{
 					"message": "Modified application " + applicationName + ", created new configuration",
 					"application": applicationName,
 				}})
 
-				api.configurationStore.Save()
+				events.PlanningTrigger.Fire("new configuration for application " + applicationName)
+				if !api.saveConfiguration(w) {
+					return
+				}
 			}
 		}
 
@@ -137,7 +273,7 @@ func (api *Api) getAllConfigurationApplications_Configurations_Latest(w http.Res
 		return
 	}
 
-	returnJson(w, nil)
+	returnError(w, http.StatusNotFound, "Could not find application " + applicationName)
 }
 
 func (api *Api) getAllRunningState(w http.ResponseWriter, r *http.Request) {
@@ -148,17 +284,28 @@ func (api *Api) hostCheckin(w http.ResponseWriter, r *http.Request) {
 	var apps model.HostCheckinDataPackage
 	hostId := r.URL.Query().Get("host")
 
+	/* A host may only check in as itself */
+	if hostId == "" || identity(r).HostId != hostId {
+		returnError(w, http.StatusForbidden, "Not allowed to check in as host " + hostId)
+		return
+	}
+
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&apps); err != nil {
 		ApiLogger.Infof("An error occurred while reading the application information")
 	}
+	if apps.Ip == "" {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			apps.Ip = ip
+		}
+	}
 
 	result, err := api.state.HostCheckin(hostId, apps)
 	if err == nil {
-		returnJson(w, result.Changes)
+		returnJson(w, api.materializeChanges(hostId, result.Changes))
 		return
 	} else {
-		returnJson(w, nil)
+		returnError(w, http.StatusInternalServerError, err.Error())
 	}
 }
 
@@ -169,4 +316,110 @@ func (api *Api) getAudit(w http.ResponseWriter, r *http.Request) {
 func (api *Api) getAuditApplication(w http.ResponseWriter, r *http.Request) {
 	applicationName := r.URL.Query().Get("application")
 	returnJson(w, state.Audit.Query__AuditEvents(applicationName))
-}
\ No newline at end of file
+}
+
+/* Runs the planner without dispatching anything. A POST body in the format of /config replaces the
+   named applications for this run only, so the effect of a config change can be checked before saving it */
+func (api *Api) previewPlan(w http.ResponseWriter, r *http.Request) {
+	hypothetical := configuration.ConfigurationStore{}
+	hypothetical.Init("")
+	for name, application := range api.configurationStore.GetAllConfiguration() {
+		hypothetical.Configurations[name] = application
+	}
+
+	if r.Method == "POST" {
+		var applications map[string]*model.ApplicationConfiguration
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&applications); err != nil {
+			returnError(w, http.StatusBadRequest, "Could not parse the hypothetical configuration - " + err.Error())
+			return
+		}
+		for name, application := range applications {
+			if application.Name == "" {
+				application.Name = name
+			}
+			if application.Config == nil {
+				application.Config = make(map[string]model.VersionConfig)
+			}
+			hypothetical.Configurations[name] = application
+		}
+	}
+
+	if r.Method == "POST" {
+		if errs := configuration.ValidateConfigurations(hypothetical.Configurations); len(errs) > 0 {
+			returnValidationErrors(w, "Invalid hypothetical configuration", errs)
+			return
+		}
+	}
+
+	returnJson(w, PlanPreview{
+		PendingChanges: api.state.HasChanges() || (api.cloudProvider != nil && api.cloudProvider.HasChanges()),
+		Changes: api.planner.Plan(hypothetical, (*api.state)),
+	})
+}
+
+/* PUT {"Mode": "paused"} sets the cluster mode, with ?application= the mode of that application.
+   An empty mode for an application makes it follow the cluster mode again */
+func (api *Api) plannerMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "POST" {
+		var object struct{ Mode string }
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&object); err != nil {
+			returnError(w, http.StatusBadRequest, "Could not parse the mode - " + err.Error())
+			return
+		}
+		if err := api.controller.SetMode(r.URL.Query().Get("application"), object.Mode, actor(r)); err != nil {
+			returnError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		events.PlanningTrigger.Fire("planner mode changed")
+	}
+
+	returnJson(w, api.controller.GetModes())
+}
+
+func (api *Api) getProposals(w http.ResponseWriter, r *http.Request) {
+	stateFilter := r.URL.Query().Get("state")
+	proposals := []planner.Proposal{}
+	for _, proposal := range api.controller.GetProposals() {
+		if stateFilter == "" || proposal.State == stateFilter {
+			proposals = append(proposals, proposal)
+		}
+	}
+	returnJson(w, proposals)
+}
+
+func (api *Api) getProposal(w http.ResponseWriter, r *http.Request) {
+	proposal, err := api.controller.GetProposal(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	returnJson(w, proposal)
+}
+
+func (api *Api) approveProposal(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := api.controller.GetProposal(id); err != nil {
+		returnError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := api.controller.Approve(id, actor(r)); err != nil {
+		returnError(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.getProposal(w, r)
+}
+
+func (api *Api) rejectProposal(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := api.controller.GetProposal(id); err != nil {
+		returnError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := api.controller.Reject(id, actor(r)); err != nil {
+		returnError(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.getProposal(w, r)
+}
@@ -0,0 +1,430 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"github.com/gorilla/mux"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/secrets"
+	"gatoor/orca/trainer/state"
+)
+
+/* Resource routes for applications and their versions:
+   /applications                          GET
+   /applications/{name}                   GET PUT PATCH DELETE
+   /applications/{name}/versions          GET POST
+   /applications/{name}/versions/{v}      GET PUT PATCH DELETE, {v} can be "latest" */
+func (api *Api) initApplicationRoutes(r *mux.Router) {
+	r.HandleFunc("/applications", api.withConfiguration(api.listApplications)).Methods("GET")
+	r.HandleFunc("/applications/{name}", api.withConfiguration(api.getApplication)).Methods("GET")
+	r.HandleFunc("/applications/{name}", api.withConfiguration(api.putApplication)).Methods("PUT")
+	r.HandleFunc("/applications/{name}", api.withConfiguration(api.patchApplication)).Methods("PATCH")
+	r.HandleFunc("/applications/{name}", api.withConfiguration(api.deleteApplication)).Methods("DELETE")
+	r.HandleFunc("/applications/{name}/versions", api.withConfiguration(api.listVersions)).Methods("GET")
+	r.HandleFunc("/applications/{name}/versions", api.withConfiguration(api.postVersion)).Methods("POST")
+	r.HandleFunc("/applications/{name}/versions/{version}", api.withConfiguration(api.getVersion)).Methods("GET")
+	r.HandleFunc("/applications/{name}/versions/{version}", api.withConfiguration(api.putVersion)).Methods("PUT")
+	r.HandleFunc("/applications/{name}/versions/{version}", api.withConfiguration(api.patchVersion)).Methods("PATCH")
+	r.HandleFunc("/applications/{name}/versions/{version}", api.withConfiguration(api.deleteVersion)).Methods("DELETE")
+}
+
+func (api *Api) applicationFromRequest(w http.ResponseWriter, r *http.Request) (*model.ApplicationConfiguration, bool) {
+	name := mux.Vars(r)["name"]
+	application, err := api.configurationStore.GetConfiguration(name)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Could not find application " + name)
+		return nil, false
+	}
+	return application, true
+}
+
+func (api *Api) versionFromRequest(w http.ResponseWriter, r *http.Request) (*model.ApplicationConfiguration, string, bool) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	version := mux.Vars(r)["version"]
+	if version == "latest" {
+		version = application.GetLatestVersion()
+	}
+	if _, exists := application.Config[version]; !exists {
+		returnError(w, http.StatusNotFound, "Could not find version " + version + " of application " + application.Name)
+		return nil, "", false
+	}
+	return application, version, true
+}
+
+/* Invalid applications, including their versions and dependency cycles, are refused with 400 before anything is changed */
+func (api *Api) validApplication(w http.ResponseWriter, name string, application *model.ApplicationConfiguration) bool {
+	errs := configuration.ValidateApplication(name, application)
+	for version, config := range application.Config {
+		for _, err := range api.unknownSecrets(config) {
+			errs = append(errs, configuration.FieldError{Field: "Config." + version + "." + err.Field, Message: err.Message})
+		}
+	}
+	if len(errs) == 0 {
+		configurations := make(map[string]*model.ApplicationConfiguration)
+		for existing, config := range api.configurationStore.GetAllConfiguration() {
+			configurations[existing] = config
+		}
+		configurations[name] = application
+		if err := configuration.ValidateDependencies(configurations); err != nil {
+			errs = append(errs, configuration.FieldError{Field: "Dependencies", Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		returnValidationErrors(w, "Invalid application " + name, errs)
+		return false
+	}
+	return true
+}
+
+func (api *Api) validVersion(w http.ResponseWriter, config model.VersionConfig) bool {
+	errs := append(configuration.ValidateVersion(config), api.unknownSecrets(config)...)
+	if len(errs) > 0 {
+		returnValidationErrors(w, "Invalid version " + config.Version, errs)
+		return false
+	}
+	return true
+}
+
+func (api *Api) unknownSecrets(config model.VersionConfig) configuration.ValidationErrors {
+	errs := configuration.ValidationErrors{}
+	check := func(field string, text string) {
+		for _, name := range secrets.ReferencesIn(text) {
+			if _, ok := api.secrets.Get(name); !ok {
+				errs = append(errs, configuration.FieldError{Field: field, Message: "references the unknown secret " + name})
+			}
+		}
+	}
+	for i, variable := range config.EnvironmentVariables {
+		check("EnvironmentVariables[" + strconv.Itoa(i) + "].Value", variable.Value)
+	}
+	for i, file := range config.Files {
+		check("Files[" + strconv.Itoa(i) + "].Base64FileContents", file.Base64FileContents)
+	}
+	return errs
+}
+
+/* False if the configuration could not be saved, the error has been returned then */
+func (api *Api) applicationChanged(w http.ResponseWriter, r *http.Request, name string, message string) bool {
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor(r), Details:map[string]string{
+		"message": message,
+		"application": name,
+	}})
+	events.PlanningTrigger.Fire(message)
+	return api.saveConfiguration(w)
+}
+
+/* The change is already active when saving fails, it would be lost with the next restart */
+func (api *Api) saveConfiguration(w http.ResponseWriter) bool {
+	if err := api.configurationStore.Save(); err != nil {
+		ApiLogger.Errorf("Could not save the configuration - %s", err)
+		returnError(w, http.StatusInternalServerError, "The change is active but could not be saved - " + err.Error())
+		return false
+	}
+	return true
+}
+
+func (api *Api) listApplications(w http.ResponseWriter, r *http.Request) {
+	listOfApplications := []*model.ApplicationConfiguration{}
+	for _, application := range api.configurationStore.GetAllConfiguration() {
+		listOfApplications = append(listOfApplications, application)
+	}
+	returnJson(w, listOfApplications)
+}
+
+func (api *Api) getApplication(w http.ResponseWriter, r *http.Request) {
+	if application, ok := api.applicationFromRequest(w, r); ok {
+		returnJson(w, application)
+	}
+}
+
+/* Creates or replaces the application, the versions, Autoscaling, Placement and Dependencies are kept if the body leaves them out.
+   Decommissioning can't be undone, applications that are going away are refused with 409 */
+func (api *Api) putApplication(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Could not read request - " + err.Error())
+		return
+	}
+	var object model.ApplicationConfiguration
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse application - " + err.Error())
+		return
+	}
+	json.Unmarshal(body, &fields)
+	if object.Name != "" && object.Name != name {
+		returnError(w, http.StatusBadRequest, "Application name " + object.Name + " does not match " + name)
+		return
+	}
+	object.Name = name
+	object.Decommission = false
+
+	application, err := api.configurationStore.GetConfiguration(name)
+	if err == nil {
+		if decommissioning(w, application) {
+			return
+		}
+		if !hasField(fields, "Autoscaling") {
+			object.Autoscaling = application.Autoscaling
+		}
+		if !hasField(fields, "Placement") {
+			object.Placement = application.Placement
+		}
+		if !hasField(fields, "Dependencies") {
+			object.Dependencies = application.Dependencies
+		}
+		if object.Config == nil {
+			object.Config = application.Config
+		}
+	}
+	if !api.validApplication(w, name, &object) {
+		return
+	}
+
+	if err != nil {
+		if object.Config == nil {
+			object.Config = make(map[string]model.VersionConfig)
+		}
+		application = api.configurationStore.Add(name, &object, actor(r))
+		if !api.applicationChanged(w, r, name, "Created application " + name) {
+			return
+		}
+		w.Header().Set("Location", "/applications/" + name)
+		returnJsonWithStatus(w, http.StatusCreated, application)
+		return
+	}
+
+	*application = object
+	if !api.applicationChanged(w, r, name, "Modified application " + name + " in pool") {
+		return
+	}
+	returnJson(w, application)
+}
+
+func (api *Api) patchApplication(w http.ResponseWriter, r *http.Request) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if decommissioning(w, application) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Could not read request - " + err.Error())
+		return
+	}
+
+	/* Fields missing from the patch keep their value, Config is copied so a bad patch doesn't leave half applied versions behind */
+	patched := *application
+	patched.Config = make(map[string]model.VersionConfig)
+	for version, config := range application.Config {
+		patched.Config[version] = config
+	}
+	if application.Autoscaling != nil {
+		policy := *application.Autoscaling
+		patched.Autoscaling = &policy
+	}
+	if err := json.Unmarshal(body, &patched); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse application patch - " + err.Error())
+		return
+	}
+	if patched.Name != application.Name {
+		returnError(w, http.StatusBadRequest, "Application name can not be changed")
+		return
+	}
+	patched.Decommission = false
+	if !api.validApplication(w, mux.Vars(r)["name"], &patched) {
+		return
+	}
+
+	*application = patched
+	if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + " in pool") {
+		return
+	}
+	returnJson(w, application)
+}
+
+/* Applications that are going away can't be changed anymore, refused with 409 */
+func decommissioning(w http.ResponseWriter, application *model.ApplicationConfiguration) bool {
+	if application.Decommission {
+		returnError(w, http.StatusConflict, "Application " + application.Name + " is being decommissioned")
+	}
+	return application.Decommission
+}
+
+/* Field names are matched like the json decoder does, case insensitive */
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Deleting is asynchronous, the application is decommissioned and disappears once the planner removed all instances.
+   Applications others still depend on are refused with 409 */
+func (api *Api) deleteApplication(w http.ResponseWriter, r *http.Request) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if dependents := configuration.Dependents(api.configurationStore.GetAllConfiguration(), application.Name); len(dependents) > 0 {
+		returnError(w, http.StatusConflict, "Application " + application.Name + " is still a dependency of " + strings.Join(dependents, ", "))
+		return
+	}
+	api.configurationStore.Decommission(application.Name, actor(r))
+	events.PlanningTrigger.Fire("application " + application.Name + " decommissioned")
+	if !api.saveConfiguration(w) {
+		return
+	}
+	returnJsonWithStatus(w, http.StatusAccepted, application)
+}
+
+func (api *Api) listVersions(w http.ResponseWriter, r *http.Request) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok {
+		return
+	}
+	versions := []model.VersionConfig{}
+	for _, version := range application.GetVersions() {
+		versions = append(versions, application.Config[version])
+	}
+	returnJson(w, versions)
+}
+
+func (api *Api) postVersion(w http.ResponseWriter, r *http.Request) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok || decommissioning(w, application) {
+		return
+	}
+
+	var object model.VersionConfig
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse version - " + err.Error())
+		return
+	}
+	object.Version = application.GetNextVersion()
+	if !api.validVersion(w, object) {
+		return
+	}
+	application.Config[object.Version] = object
+
+	if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + ", created new configuration") {
+		return
+	}
+	w.Header().Set("Location", "/applications/" + application.Name + "/versions/" + object.Version)
+	returnJsonWithStatus(w, http.StatusCreated, object)
+}
+
+func (api *Api) getVersion(w http.ResponseWriter, r *http.Request) {
+	if application, version, ok := api.versionFromRequest(w, r); ok {
+		returnJson(w, application.Config[version])
+	}
+}
+
+/* Creates or replaces a specific version */
+func (api *Api) putVersion(w http.ResponseWriter, r *http.Request) {
+	application, ok := api.applicationFromRequest(w, r)
+	if !ok || decommissioning(w, application) {
+		return
+	}
+	version := mux.Vars(r)["version"]
+	if version == "latest" {
+		version = application.GetLatestVersion()
+	}
+	if iversion, err := strconv.Atoi(version); err != nil || iversion <= 0 {
+		returnError(w, http.StatusBadRequest, "Version must be a positive number")
+		return
+	}
+
+	var object model.VersionConfig
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse version - " + err.Error())
+		return
+	}
+	object.Version = version
+	if !api.validVersion(w, object) {
+		return
+	}
+
+	_, exists := application.Config[version]
+	application.Config[version] = object
+	if !exists {
+		if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + ", created configuration " + version) {
+			return
+		}
+		w.Header().Set("Location", "/applications/" + application.Name + "/versions/" + version)
+		returnJsonWithStatus(w, http.StatusCreated, object)
+		return
+	}
+	if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + ", replaced configuration " + version) {
+		return
+	}
+	returnJson(w, object)
+}
+
+func (api *Api) patchVersion(w http.ResponseWriter, r *http.Request) {
+	application, version, ok := api.versionFromRequest(w, r)
+	if !ok || decommissioning(w, application) {
+		return
+	}
+
+	patched := application.Config[version]
+	if err := json.NewDecoder(r.Body).Decode(&patched); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse version patch - " + err.Error())
+		return
+	}
+	patched.Version = version
+	if !api.validVersion(w, patched) {
+		return
+	}
+	application.Config[version] = patched
+
+	if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + ", changed configuration " + version) {
+		return
+	}
+	returnJson(w, patched)
+}
+
+func (api *Api) deleteVersion(w http.ResponseWriter, r *http.Request) {
+	application, version, ok := api.versionFromRequest(w, r)
+	if !ok || decommissioning(w, application) {
+		return
+	}
+	delete(application.Config, version)
+	if !api.applicationChanged(w, r, application.Name, "Modified application " + application.Name + ", removed configuration " + version) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
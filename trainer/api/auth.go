@@ -0,0 +1,103 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"gatoor/orca/trainer/auth"
+)
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+/* Host agents may only check in, everything else is for operators */
+func requiredRole(r *http.Request) string {
+	if r.URL.Path == "/checkin" {
+		return auth.ROLE_HOST_AGENT
+	}
+	return auth.ROLE_OPERATOR
+}
+
+func (api *Api) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := requiredRole(r)
+
+		/* With mutual TLS the client certificate is the credential of the host agents. Hosts that did not get one
+		   at bootstrap check in with their token */
+		if role == auth.ROLE_HOST_AGENT && api.certificateAuthority != nil {
+			hostId, valid := api.certificateAuthority.HostIdFromConnection(r.TLS)
+			if !valid {
+				ApiLogger.Infof("Revoked client certificate of host %s refused", hostId)
+				returnError(w, http.StatusUnauthorized, "The client certificate was revoked")
+				return
+			}
+			if hostId != "" {
+				identity := auth.Identity{Name: hostId, Role: auth.ROLE_HOST_AGENT, HostId: hostId}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, identity)))
+				return
+			}
+			if api.authenticator == nil || !api.authenticator.Enabled {
+				returnError(w, http.StatusUnauthorized, "A client certificate is required")
+				return
+			}
+		}
+
+		if api.authenticator == nil || !api.authenticator.Enabled {
+			identity := auth.Identity{Name: "anonymous", Role: role}
+			if role == auth.ROLE_HOST_AGENT {
+				identity.HostId = r.URL.Query().Get("host")
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, identity)))
+			return
+		}
+
+		/* Only "Bearer <token>", anything else is refused before the token is looked at */
+		header := r.Header.Get("Authorization")
+		identity, ok := auth.Identity{}, strings.HasPrefix(header, "Bearer ")
+		if ok {
+			identity, ok = api.authenticator.Authenticate(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			returnError(w, http.StatusUnauthorized, "Missing or invalid token")
+			return
+		}
+		if identity.Role != role {
+			ApiLogger.Infof("%s with role %s denied access to %s", identity.Actor(), identity.Role, r.URL.Path)
+			returnError(w, http.StatusForbidden, "Role " + identity.Role + " is not allowed to access " + r.URL.Path)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, identity)))
+	})
+}
+
+func identity(r *http.Request) auth.Identity {
+	if identity, ok := r.Context().Value(identityContextKey).(auth.Identity); ok {
+		return identity
+	}
+	return auth.Identity{Name: "anonymous"}
+}
+
+func actor(r *http.Request) string {
+	return identity(r).Actor()
+}
@@ -0,0 +1,64 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"github.com/gorilla/mux"
+)
+
+/* The labels the planner places by, the ones from the cloud provider merged with the ones set here */
+func (api *Api) getHostLabels(w http.ResponseWriter, r *http.Request) {
+	hostId := mux.Vars(r)["id"]
+	host, err := api.state.GetConfiguration(hostId)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Could not find host " + hostId)
+		return
+	}
+	returnJson(w, host.GetLabels())
+}
+
+/* Replaces the labels set by operators, labels from the cloud provider can be overridden but not removed */
+func (api *Api) putHostLabels(w http.ResponseWriter, r *http.Request) {
+	hostId := mux.Vars(r)["id"]
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse labels - " + err.Error())
+		return
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if _, err := api.state.GetConfiguration(hostId); err != nil {
+		returnError(w, http.StatusNotFound, "Could not find host " + hostId)
+		return
+	}
+	if err := api.state.SetLabels(hostId, labels, actor(r)); err != nil {
+		returnError(w, http.StatusInternalServerError, "Could not save the labels - " + err.Error())
+		return
+	}
+	/* A copy, taken after the change */
+	host, err := api.state.GetConfiguration(hostId)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Could not find host " + hostId)
+		return
+	}
+	returnJson(w, host.GetLabels())
+}
@@ -0,0 +1,40 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"net/http"
+	"github.com/gorilla/mux"
+)
+
+/* The backend pools for external load balancer controllers, the same the file outputs get */
+func (api *Api) listLoadBalancers(w http.ResponseWriter, r *http.Request) {
+	returnJson(w, api.loadBalancers.Current())
+}
+
+func (api *Api) getLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, balancer := range api.loadBalancers.Current() {
+		if balancer.Name == name {
+			returnJson(w, balancer)
+			return
+		}
+	}
+	returnError(w, http.StatusNotFound, "Could not find load balancer " + name)
+}
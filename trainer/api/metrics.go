@@ -0,0 +1,93 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"gatoor/orca/trainer/metrics"
+)
+
+/* How far back /metrics/history looks without a from */
+const DEFAULT_HISTORY_RANGE = time.Hour
+
+/* Prometheus text format, the trainer internals plus the latest metrics the hosts sent with their checkin */
+func (api *Api) getMetrics(w http.ResponseWriter, r *http.Request) {
+	scrape := metrics.Registry{}
+	scrape.Describe("orca_hosts", metrics.TYPE_GAUGE, "Known hosts by state")
+	scrape.Describe("orca_host_applications", metrics.TYPE_GAUGE, "Applications on a host by state and health")
+	scrape.Describe("orca_application_cpu_usage", metrics.TYPE_GAUGE, "Cpu usage of an application on a host")
+	scrape.Describe("orca_application_memory_usage", metrics.TYPE_GAUGE, "Memory usage of an application on a host")
+	scrape.Describe("orca_application_network_usage", metrics.TYPE_GAUGE, "Network usage of an application on a host")
+
+	hostsByState := make(map[string]int)
+	for _, host := range api.state.GetAllHosts() {
+		hostsByState[host.State]++
+
+		for _, application := range host.Apps {
+			labels := metrics.Labels{"host": host.Id, "application": application.Name, "state": application.State, "health": application.Health}
+			scrape.Add("orca_host_applications", labels, 1)
+		}
+		for application, metric := range host.Metrics {
+			labels := metrics.Labels{"host": host.Id, "application": application}
+			scrape.Set("orca_application_cpu_usage", labels, float64(metric.CpuUsage))
+			scrape.Set("orca_application_memory_usage", labels, float64(metric.MemoryUsage))
+			scrape.Set("orca_application_network_usage", labels, float64(metric.NetworkUsage))
+		}
+	}
+	for hostState, count := range hostsByState {
+		scrape.Set("orca_hosts", metrics.Labels{"state": hostState}, float64(count))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Trainer.WriteText(w)
+	scrape.WriteText(w)
+}
+
+/* Samples of the metrics history, filtered by the host and application query parameters.
+   from and to are RFC3339 or unix seconds, the last hour by default */
+func (api *Api) getMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid to: " + err.Error())
+		return
+	}
+	from, err := parseTime(query.Get("from"), to.Add(-DEFAULT_HISTORY_RANGE))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid from: " + err.Error())
+		return
+	}
+	if from.After(to) {
+		returnError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	returnJson(w, api.state.History.Query(query.Get("host"), query.Get("application"), from, to))
+}
+
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
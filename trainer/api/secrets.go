@@ -0,0 +1,127 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"github.com/gorilla/mux"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/secrets"
+	"gatoor/orca/trainer/state"
+)
+
+/* Secret values can be set but never read back */
+func (api *Api) listSecrets(w http.ResponseWriter, r *http.Request) {
+	returnJson(w, api.secrets.List())
+}
+
+func (api *Api) getSecret(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	info, ok := api.secrets.Get(name)
+	if !ok {
+		returnError(w, http.StatusNotFound, "Could not find secret " + name)
+		return
+	}
+	returnJson(w, info)
+}
+
+/* PUT {"Value": "..."} creates or replaces a secret, versions referencing it get the new value with their next change */
+func (api *Api) putSecret(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var object struct{ Value string }
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		returnError(w, http.StatusBadRequest, "Could not parse the secret - " + err.Error())
+		return
+	}
+	_, existed := api.secrets.Get(name)
+	info, err := api.secrets.Set(name, object.Value, actor(r))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message := "Created secret " + name
+	if existed {
+		message = "Changed secret " + name
+	}
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor(r), Details:map[string]string{
+		"message": message,
+		"secret": name,
+	}})
+	returnJson(w, info)
+}
+
+/* Secrets still referenced by a version are refused with 409, the hosts could not get them anymore */
+func (api *Api) deleteSecret(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := api.secrets.Get(name); !ok {
+		returnError(w, http.StatusNotFound, "Could not find secret " + name)
+		return
+	}
+	if users := api.secretUsers(name); len(users) > 0 {
+		returnError(w, http.StatusConflict, "Secret " + name + " is still referenced by " + strings.Join(users, ", "))
+		return
+	}
+	if err := api.secrets.Delete(name); err != nil {
+		returnError(w, http.StatusInternalServerError, "Could not delete secret " + name + " - " + err.Error())
+		return
+	}
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor(r), Details:map[string]string{
+		"message": "Deleted secret " + name,
+		"secret": name,
+	}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* application:version of every version referencing the secret */
+func (api *Api) secretUsers(name string) []string {
+	users := []string{}
+	for applicationName, application := range api.configurationStore.GetAllConfiguration() {
+		for version, config := range application.Config {
+			for _, reference := range secrets.References(config) {
+				if reference == name {
+					users = append(users, applicationName + ":" + version)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+/* The changes as the host gets them, with the secret values in place. A change whose secrets are gone is held
+   back, the host would start the application without them, and times out like any other change */
+func (api *Api) materializeChanges(hostId string, changes []model.ChangeApplication) []model.ChangeApplication {
+	materialized := []model.ChangeApplication{}
+	for _, change := range changes {
+		config, err := api.secrets.Materialize(change.AppConfig)
+		if err != nil {
+			ApiLogger.Errorf("Holding back change %s of application %s for host %s - %s", change.Id, change.Name, hostId, err)
+			continue
+		}
+		change.AppConfig = config
+		materialized = append(materialized, change)
+	}
+	return materialized
+}
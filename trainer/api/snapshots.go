@@ -0,0 +1,65 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"net/http"
+	"github.com/gorilla/mux"
+	"gatoor/orca/trainer/events"
+)
+
+/* Previous versions of the whole configuration, newest first */
+func (api *Api) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := api.configurationStore.ListSnapshots()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Could not list snapshots - " + err.Error())
+		return
+	}
+	returnJson(w, snapshots)
+}
+
+/* The applications of the snapshot in the format of /config */
+func (api *Api) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	configurations, err := api.configurationStore.ReadSnapshot(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	returnJson(w, configurations)
+}
+
+/* Snapshots that are no longer valid, e.g. after the validation got stricter, are refused with 409 */
+func (api *Api) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := api.configurationStore.ReadSnapshot(id); err != nil {
+		returnError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	errs, err := api.configurationStore.RestoreSnapshot(id, actor(r))
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Could not restore snapshot " + id + " - " + err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		returnJsonWithStatus(w, http.StatusConflict, ApiError{Status: http.StatusConflict, Error: "Snapshot " + id + " is not a valid configuration - " + errs.Error(), Fields: errs})
+		return
+	}
+	events.PlanningTrigger.Fire("configuration snapshot " + id + " restored")
+	returnJson(w, api.configurationStore.GetAllConfiguration())
+}
@@ -0,0 +1,89 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"gatoor/orca/trainer/events"
+)
+
+/* Keeps proxies from closing idle streams */
+const STREAM_KEEPALIVE = time.Second * 15
+
+/* Server-sent events stream of everything happening in the cluster.
+   ?application=, ?host= and ?type= (comma separated) narrow it down */
+func (api *Api) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		returnError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	application := r.URL.Query().Get("application")
+	host := r.URL.Query().Get("host")
+	types := make(map[string]bool)
+	for _, eventType := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if eventType != "" {
+			types[eventType] = true
+		}
+	}
+
+	subscriber := events.Cluster.Subscribe()
+	defer events.Cluster.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <- r.Context().Done():
+			return
+		case <- keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event := <- subscriber:
+			if application != "" && event.Application != application {
+				continue
+			}
+			if host != "" && event.HostId != host {
+				continue
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				ApiLogger.Errorf("Json serialization failed - %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+const (
+	ROLE_OPERATOR   = "operator"
+	ROLE_HOST_AGENT = "host-agent"
+)
+
+var AuthLogger = Logger.LoggerWithField(Logger.Logger, "module", "auth")
+
+type Identity struct {
+	Name   string
+	Role   string
+	/* Only set for host agents */
+	HostId string
+}
+
+/* Used for the audit log */
+func (identity Identity) Actor() string {
+	if identity.Role == ROLE_HOST_AGENT {
+		return "host:" + identity.HostId
+	}
+	return identity.Name
+}
+
+type OperatorToken struct {
+	Name  string
+	Token string
+}
+
+/* Tokens are only kept as sha256 hashes, the host tokens are persisted so hosts survive a trainer restart */
+type Authenticator struct {
+	Enabled bool
+
+	identities     map[string]Identity
+	hostTokens     map[string]string
+	hostTokensFile string
+	lock           sync.RWMutex
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (authenticator *Authenticator) Init(enabled bool, operators []OperatorToken, hostTokensFile string) {
+	authenticator.Enabled = enabled
+	authenticator.identities = make(map[string]Identity)
+	authenticator.hostTokens = make(map[string]string)
+	authenticator.hostTokensFile = hostTokensFile
+
+	for _, operator := range operators {
+		authenticator.identities[hashToken(operator.Token)] = Identity{Name: operator.Name, Role: ROLE_OPERATOR}
+	}
+
+	content, err := ioutil.ReadFile(hostTokensFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			AuthLogger.Errorf("Could not read host tokens from %s - %s", hostTokensFile, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(content, &authenticator.hostTokens); err != nil {
+		AuthLogger.Errorf("Could not parse host tokens from %s - %s", hostTokensFile, err)
+		return
+	}
+	for hostId, hash := range authenticator.hostTokens {
+		authenticator.identities[hash] = Identity{Name: hostId, Role: ROLE_HOST_AGENT, HostId: hostId}
+	}
+}
+
+func (authenticator *Authenticator) Authenticate(token string) (Identity, bool) {
+	if token == "" {
+		return Identity{}, false
+	}
+	authenticator.lock.RLock()
+	defer authenticator.lock.RUnlock()
+
+	identity, ok := authenticator.identities[hashToken(token)]
+	return identity, ok
+}
+
+/* Called when a new host is bootstrapped, replaces any token the host had before */
+func (authenticator *Authenticator) IssueHostToken(hostId string) string {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		AuthLogger.Errorf("Could not generate token for host %s - %s", hostId, err)
+		return ""
+	}
+	token := hex.EncodeToString(buffer)
+
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+
+	if previous, ok := authenticator.hostTokens[hostId]; ok {
+		delete(authenticator.identities, previous)
+	}
+	hash := hashToken(token)
+	authenticator.hostTokens[hostId] = hash
+	authenticator.identities[hash] = Identity{Name: hostId, Role: ROLE_HOST_AGENT, HostId: hostId}
+	authenticator.saveHostTokens()
+
+	return token
+}
+
+func (authenticator *Authenticator) RevokeHost(hostId string) {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+
+	if hash, ok := authenticator.hostTokens[hostId]; ok {
+		delete(authenticator.identities, hash)
+		delete(authenticator.hostTokens, hostId)
+		authenticator.saveHostTokens()
+	}
+}
+
+func (authenticator *Authenticator) saveHostTokens() {
+	if authenticator.hostTokensFile == "" {
+		return
+	}
+	content, err := json.MarshalIndent(authenticator.hostTokens, "", "  ")
+	if err != nil {
+		AuthLogger.Errorf("Could not serialize host tokens - %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(authenticator.hostTokensFile, content, 0600); err != nil {
+		AuthLogger.Errorf("Could not write host tokens to %s - %s", authenticator.hostTokensFile, err)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CA_VALIDITY        = time.Hour * 24 * 365 * 10
+	HOST_CERT_VALIDITY = time.Hour * 24 * 365
+)
+
+/* A small CA for mutual TLS with the host agents. The CA is created on first start and the
+   hosts get a client certificate with their host id as common name when they are bootstrapped */
+type CertificateAuthority struct {
+	certificate    *x509.Certificate
+	certificatePem []byte
+	key            *ecdsa.PrivateKey
+
+	lock        sync.RWMutex
+	serials     hostSerials
+	serialsFile string
+}
+
+type issuedCertificate struct {
+	Serial   string
+	NotAfter time.Time
+}
+
+/* The certificate issued to each host and the revoked ones until they expire, kept in a file so a terminated host
+   stays locked out after a trainer restart */
+type hostSerials struct {
+	Issued  map[string]issuedCertificate
+	Revoked map[string]time.Time
+}
+
+func (ca *CertificateAuthority) Init(certFile string, keyFile string, serialsFile string) error {
+	certPem, certErr := ioutil.ReadFile(certFile)
+	keyPem, keyErr := ioutil.ReadFile(keyFile)
+
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		AuthLogger.Infof("No CA found at %s, creating a new one", certFile)
+		var err error
+		certPem, keyPem, err = createCertificateAuthority()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+			return err
+		}
+	} else if certErr != nil {
+		return certErr
+	} else if keyErr != nil {
+		return keyErr
+	}
+
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return errors.New("Could not decode the CA certificate or key")
+	}
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	ca.certificate = certificate
+	ca.certificatePem = certPem
+	ca.key = key
+	return ca.loadSerials(serialsFile)
+}
+
+func (ca *CertificateAuthority) loadSerials(serialsFile string) error {
+	ca.serialsFile = serialsFile
+	ca.serials = hostSerials{Issued: make(map[string]issuedCertificate), Revoked: make(map[string]time.Time)}
+	content, err := ioutil.ReadFile(serialsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(content, &ca.serials); err != nil {
+		return errors.New("Could not parse the host certificates in " + serialsFile + " - " + err.Error())
+	}
+	if ca.serials.Issued == nil {
+		ca.serials.Issued = make(map[string]issuedCertificate)
+	}
+	if ca.serials.Revoked == nil {
+		ca.serials.Revoked = make(map[string]time.Time)
+	}
+	return nil
+}
+
+func createCertificateAuthority() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: "orca trainer CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(CA_VALIDITY),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+/* Returns the PEM encoded client certificate and key for the host, a certificate issued to the host before is revoked */
+func (ca *CertificateAuthority) IssueHostCertificate(hostId string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: hostId},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(HOST_CERT_VALIDITY),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	ca.revoke(hostId)
+	ca.serials.Issued[hostId] = issuedCertificate{Serial: serial.Text(16), NotAfter: template.NotAfter}
+	if err := ca.saveSerials(); err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+/* Called when the host is terminated, its certificate is refused from then on */
+func (ca *CertificateAuthority) RevokeHost(hostId string) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	if !ca.revoke(hostId) {
+		return
+	}
+	if err := ca.saveSerials(); err != nil {
+		AuthLogger.Errorf("Could not save the revoked certificate of host %s - %s", hostId, err)
+	}
+}
+
+/* The caller holds the lock. Returns false if the host had no certificate */
+func (ca *CertificateAuthority) revoke(hostId string) bool {
+	issued, ok := ca.serials.Issued[hostId]
+	if !ok {
+		return false
+	}
+	ca.serials.Revoked[issued.Serial] = issued.NotAfter
+	delete(ca.serials.Issued, hostId)
+	return true
+}
+
+/* The caller holds the lock. Revoked certificates that expired are dropped, they are refused anyway */
+func (ca *CertificateAuthority) saveSerials() error {
+	for serial, notAfter := range ca.serials.Revoked {
+		if time.Now().After(notAfter) {
+			delete(ca.serials.Revoked, serial)
+		}
+	}
+	if ca.serialsFile == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(ca.serials, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ca.serialsFile, content, 0600)
+}
+
+func (ca *CertificateAuthority) CertificatePem() []byte {
+	return ca.certificatePem
+}
+
+func (ca *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+/* Client certificates are optional on the connection level so operators can keep using tokens,
+   whether a route needs one is decided per request */
+func (ca *CertificateAuthority) ServerTlsConfig() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs: ca.CertPool(),
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+/* The host id of a verified client certificate, empty if the connection has none. False if the certificate was revoked */
+func (ca *CertificateAuthority) HostIdFromConnection(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", true
+	}
+	certificate := state.VerifiedChains[0][0]
+
+	ca.lock.RLock()
+	defer ca.lock.RUnlock()
+	if _, revoked := ca.serials.Revoked[certificate.SerialNumber.Text(16)]; revoked {
+		return certificate.Subject.CommonName, false
+	}
+	return certificate.Subject.CommonName, true
+}
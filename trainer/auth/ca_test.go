@@ -0,0 +1,109 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCertificateAuthority(t *testing.T, dir string) *CertificateAuthority {
+	ca := &CertificateAuthority{}
+	if err := ca.Init(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), filepath.Join(dir, "hostcertificates.json")); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+/* The connection state of a host presenting the certificate, as the tls server verifies it */
+func connection(t *testing.T, ca *CertificateAuthority, hostId string) *tls.ConnectionState {
+	certPem, _, err := ca.IssueHostCertificate(hostId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPem)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains, err := certificate.Verify(x509.VerifyOptions{Roots: ca.CertPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.ConnectionState{VerifiedChains: chains}
+}
+
+func TestRevokeHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orca-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := testCertificateAuthority(t, dir)
+
+	first := connection(t, ca, "host1")
+	second := connection(t, ca, "host1")
+	other := connection(t, ca, "host2")
+	ca.RevokeHost("host2")
+	ca.RevokeHost("host3")
+
+	/* The CA is loaded again to check the revocations outlive a restart */
+	restarted := testCertificateAuthority(t, dir)
+	tests := []struct {
+		name       string
+		connection *tls.ConnectionState
+		hostId     string
+		valid      bool
+	}{
+		{"no certificate", &tls.ConnectionState{}, "", true},
+		{"replaced by a new certificate", first, "host1", false},
+		{"current certificate", second, "host1", true},
+		{"terminated host", other, "host2", false},
+	}
+	for _, test := range tests {
+		for _, authority := range []*CertificateAuthority{ca, restarted} {
+			hostId, valid := authority.HostIdFromConnection(test.connection)
+			if hostId != test.hostId || valid != test.valid {
+				t.Errorf("%s: expected %q valid %t, got %q valid %t", test.name, test.hostId, test.valid, hostId, valid)
+			}
+		}
+	}
+}
+
+func TestRevokedCertificatesAreDroppedAfterExpiry(t *testing.T) {
+	ca := &CertificateAuthority{}
+	ca.loadSerials("")
+	ca.serials.Issued["host1"] = issuedCertificate{Serial: "1", NotAfter: time.Now().Add(-time.Minute)}
+	ca.serials.Issued["host2"] = issuedCertificate{Serial: "2", NotAfter: time.Now().Add(time.Hour)}
+	ca.RevokeHost("host1")
+	ca.RevokeHost("host2")
+
+	if _, ok := ca.serials.Revoked["1"]; ok {
+		t.Error("expected the expired certificate to be dropped")
+	}
+	if _, ok := ca.serials.Revoked["2"]; !ok {
+		t.Error("expected the certificate to stay revoked until it expires")
+	}
+}
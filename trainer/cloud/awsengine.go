@@ -7,6 +7,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 )
 
 type AwsCloudEngine struct {
@@ -17,6 +19,15 @@ type AwsCloudEngine struct {
 	sshKey          string
 	sshKeyPath	string
 	securityGroupId          string
+
+	/* Optional VPC settings, if no subnets are given the default VPC is used */
+	subnetIds          []string
+	/* Instances are spawned on their own goroutines */
+	subnetLock         sync.Mutex
+	nextSubnet         int
+	usePrivateIp       bool
+	instanceProfile    string
+	rootVolumeSize     int64
 }
 
 func (aws *AwsCloudEngine) Init(awsAccessKeyId string, awsAccessKeySecret string, awsRegion string, awsBaseAmi string, sshKey string,sshKeyPath string, securityGroupId string) {
@@ -33,6 +44,15 @@ func (aws *AwsCloudEngine) Init(awsAccessKeyId string, awsAccessKeySecret string
 	os.Setenv("AWS_SECRET_ACCESS_KEY", aws.awsAccessKeySecret)
 }
 
+/* Subnets are used round robin, usePrivateIp means the trainer talks to the instances over their private address
+   (e.g. the trainer runs in the same VPC), rootVolumeSize is in GiB and 0 keeps the size of the AMI */
+func (aws *AwsCloudEngine) ConfigureInstances(subnetIds []string, usePrivateIp bool, instanceProfile string, rootVolumeSize int64) {
+	aws.subnetIds = subnetIds
+	aws.usePrivateIp = usePrivateIp
+	aws.instanceProfile = instanceProfile
+	aws.rootVolumeSize = rootVolumeSize
+}
+
 func (a *AwsCloudEngine) getInstanceInfo(hostId HostId) (*ec2.Instance, error) {
 	svc := ec2.New(session.New(&aws.Config{Region: aws.String(a.awsRegion)}))
 	res, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{string(hostId)}), })
@@ -51,7 +71,60 @@ func (a *AwsCloudEngine) GetIp(hostId HostId) string {
 		return ""
 	}
 
-	return string(*info.PublicIpAddress)
+	if !a.usePrivateIp && info.PublicIpAddress != nil {
+		return *info.PublicIpAddress
+	}
+
+	if !a.usePrivateIp {
+		fmt.Printf("AwsCloudEngine GetIp: %s has no public ip, falling back to the private one\n", hostId)
+	}
+
+	if info.PrivateIpAddress != nil {
+		return *info.PrivateIpAddress
+	}
+	return ""
+}
+
+/* The availability zone, the instance type and the tags of the instance */
+func (a *AwsCloudEngine) GetLabels(hostId HostId) map[string]string {
+	labels := make(map[string]string)
+	info, err := a.getInstanceInfo(hostId)
+	if err != nil {
+		fmt.Printf("AwsCloudEngine GetLabels for %s failed: %s\n", hostId, err)
+		return labels
+	}
+	if info.Placement != nil && info.Placement.AvailabilityZone != nil {
+		labels["zone"] = *info.Placement.AvailabilityZone
+	}
+	if info.InstanceType != nil {
+		labels["instancetype"] = *info.InstanceType
+	}
+	for _, tag := range info.Tags {
+		if tag.Key != nil && tag.Value != nil {
+			labels[*tag.Key] = *tag.Value
+		}
+	}
+	return labels
+}
+
+func (a *AwsCloudEngine) nextSubnetId() string {
+	if len(a.subnetIds) == 0 {
+		return ""
+	}
+	a.subnetLock.Lock()
+	defer a.subnetLock.Unlock()
+	subnetId := a.subnetIds[a.nextSubnet % len(a.subnetIds)]
+	a.nextSubnet++
+	return subnetId
+}
+
+func (a *AwsCloudEngine) getRootDeviceName(svc *ec2.EC2) string {
+	res, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{a.awsBaseAmi}), })
+	if err != nil || len(res.Images) != 1 || res.Images[0].RootDeviceName == nil {
+		fmt.Println("AwsCloudEngine could not get the root device of the base AMI, assuming /dev/sda1 ", err)
+		return "/dev/sda1"
+	}
+	return *res.Images[0].RootDeviceName
 }
 
 
@@ -59,7 +132,7 @@ func (a *AwsCloudEngine) waitOnInstanceReady(hostId HostId) bool {
 	svc := ec2.New(session.New(&aws.Config{Region: aws.String(a.awsRegion)}))
 
 	if err := svc.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{string(hostId)}), }); err != nil {
-		fmt.Println("WaitOnInstanceReady for %s failed: %s", hostId, err)
+		fmt.Printf("WaitOnInstanceReady for %s failed: %s\n", hostId, err)
 	}
 	return true
 }
@@ -69,14 +142,51 @@ func (engine *AwsCloudEngine) SpawnInstanceSync(instanceType InstanceType) HostI
 	fmt.Println("AwsCloudEngine SpawnInstanceSync called with ", instanceType)
 	svc := ec2.New(session.New(&aws.Config{Region: aws.String(engine.awsRegion)}))
 
-	runResult, err := svc.RunInstances(&ec2.RunInstancesInput{
+	input := &ec2.RunInstancesInput{
 		ImageId:      aws.String(engine.awsBaseAmi),
 		InstanceType: aws.String(string(instanceType)),
 		MinCount:     aws.Int64(1),
 		MaxCount:     aws.Int64(1),
 		KeyName:      &engine.sshKey,
 		SecurityGroupIds: aws.StringSlice([]string{string(engine.securityGroupId)}),
-	})
+	}
+
+	if subnetId := engine.nextSubnetId(); subnetId != "" {
+		if engine.usePrivateIp {
+			input.SubnetId = aws.String(subnetId)
+		} else {
+			/* Subnets don't necessarily hand out public ips, so we have to ask for one on the interface.
+			   AWS refuses the request if the subnet and groups are set on the instance as well */
+			input.SecurityGroupIds = nil
+			input.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{{
+				DeviceIndex: aws.Int64(0),
+				SubnetId: aws.String(subnetId),
+				Groups: aws.StringSlice([]string{string(engine.securityGroupId)}),
+				AssociatePublicIpAddress: aws.Bool(true),
+				DeleteOnTermination: aws.Bool(true),
+			}}
+		}
+	}
+
+	if engine.instanceProfile != "" {
+		if strings.HasPrefix(engine.instanceProfile, "arn:") {
+			input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(engine.instanceProfile)}
+		} else {
+			input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: aws.String(engine.instanceProfile)}
+		}
+	}
+
+	if engine.rootVolumeSize > 0 {
+		input.BlockDeviceMappings = []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String(engine.getRootDeviceName(svc)),
+			Ebs: &ec2.EbsBlockDevice{
+				VolumeSize: aws.Int64(engine.rootVolumeSize),
+				DeleteOnTermination: aws.Bool(true),
+			},
+		}}
+	}
+
+	runResult, err := svc.RunInstances(input)
 
 	if err != nil {
 		fmt.Println("AwsCloudEngine SpawnInstanceSync encountered an error ", err)
@@ -98,8 +208,15 @@ func (aws *AwsCloudEngine) GetInstanceType(HostId) InstanceType {
 
 }
 
-func (aws *AwsCloudEngine) TerminateInstance(HostId) bool {
-	return false
+func (engine *AwsCloudEngine) TerminateInstance(hostId HostId) bool {
+	svc := ec2.New(session.New(&aws.Config{Region: aws.String(engine.awsRegion)}))
+
+	if _, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: aws.StringSlice([]string{string(hostId)}), }); err != nil {
+		fmt.Printf("AwsCloudEngine TerminateInstance for %s failed: %s\n", hostId, err)
+		return false
+	}
+	fmt.Println("AwsCloudEngine TerminateInstance terminated ", hostId)
+	return true
 }
 
 func (aws *AwsCloudEngine) GetPem() string {
@@ -22,14 +22,32 @@ package cloud
 import (
 	"gatoor/orca/trainer/model"
 	orcaSSh "gatoor/orca/util"
+	"fmt"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/metrics"
 )
 
+/* Hands out the token a new host uses to check in, and takes it back when the host is terminated */
+type CredentialIssuer interface {
+	IssueHostToken(hostId string) string
+	RevokeHost(hostId string)
+}
+
+/* Hands out the client certificate a new host uses for mutual TLS, all PEM encoded, and revokes it when the host is terminated */
+type CertificateIssuer interface {
+	IssueHostCertificate(hostId string) ([]byte, []byte, error)
+	CertificatePem() []byte
+	RevokeHost(hostId string)
+}
+
 type CloudProvider struct {
 	Engine CloudEngine
 	Changes []*model.ChangeServer
 
 	apiEndpoint string
 	sshUser string
+	credentials CredentialIssuer
+	certificates CertificateIssuer
 }
 
 func (cloud* CloudProvider) Init(engine CloudEngine, sshUser string, apiEndpoint string){
@@ -38,9 +56,20 @@ func (cloud* CloudProvider) Init(engine CloudEngine, sshUser string, apiEndpoint
 	cloud.sshUser= sshUser
 }
 
+/* Without an issuer hosts are bootstrapped without a token */
+func (cloud* CloudProvider) SetCredentialIssuer(credentials CredentialIssuer) {
+	cloud.credentials = credentials
+}
+
+/* Without an issuer hosts are bootstrapped without a client certificate */
+func (cloud* CloudProvider) SetCertificateIssuer(certificates CertificateIssuer) {
+	cloud.certificates = certificates
+}
+
 func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 	/* First push this change onto the change queue for the cloud provider */
 	cloud.AddChange(change)
+	events.PublishChange(change.HostId, "", change.Id, change.Type, events.CHANGE_CREATED)
 
 	go func() {
 		/* Here we can spawn a new server */
@@ -55,6 +84,34 @@ func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 				ipAddr := cloud.Engine.GetIp(newHostId)
 				sshKeyPath := cloud.Engine.GetPem()
 
+				/* Credentials are written to files over ssh, on the command line they would be visible in ps */
+				type hostFile struct {
+					path    string
+					content []byte
+				}
+				files := []hostFile{}
+				tokenArgument := ""
+				if cloud.credentials != nil {
+					files = append(files, hostFile{"/orca/client/config/host.token", []byte(cloud.credentials.IssueHostToken(string(newHostId)))})
+					tokenArgument = " --tokenfile /orca/client/config/host.token"
+				}
+
+				if cloud.certificates != nil {
+					certPem, keyPem, err := cloud.certificates.IssueHostCertificate(string(newHostId))
+					if err != nil && cloud.credentials != nil {
+						fmt.Printf("Could not issue a client certificate for %s, it checks in with its token: %s\n", newHostId, err)
+					} else if err != nil {
+						fmt.Printf("Could not issue a client certificate for %s, it will not be able to check in: %s\n", newHostId, err)
+					} else {
+						tokenArgument += " --clientcert /orca/client/config/host.crt --clientkey /orca/client/config/host.key --cacert /orca/client/config/ca.crt"
+						files = append(files,
+							hostFile{"/orca/client/config/host.crt", certPem},
+							hostFile{"/orca/client/config/host.key", keyPem},
+							hostFile{"/orca/client/config/ca.crt", cloud.certificates.CertificatePem()},
+						)
+					}
+				}
+
 				for {
 					session, addr := orcaSSh.Connect(cloud.sshUser, string(ipAddr) + ":22", sshKeyPath)
 					if session == nil {
@@ -62,7 +119,7 @@ func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 					}
 
 					SUPERVISOR_CONFIG := "'[unix_http_server]\\nfile=/var/run/supervisor.sock\\nchmod=0770\\nchown=root:supervisor\\n[supervisord]\\nlogfile=/var/log/supervisor/supervisord.log\\npidfile=/var/run/supervisord.pid\\nchildlogdir=/var/log/supervisor\\n[rpcinterface:supervisor]\\nsupervisor.rpcinterface_factory = supervisor.rpcinterface:make_main_rpcinterface\\n[supervisorctl]\\nserverurl=unix:///var/run/supervisor.sock\\n[include]\\nfiles = /etc/supervisor/conf.d/*.conf' > /etc/supervisor/supervisord.conf"
-					ORCA_SUPERVISOR_CONFIG := "'[program:orca_client]\\ncommand=/orca/bin/orcahostd --interval 30 --hostid "+string(newHostId)+" --traineruri "+cloud.apiEndpoint+"\\nautostart=true\\nautorestart=true\\nstartretries=2\\nuser=root\\nredirect_stderr=true\\nstdout_logfile=/orca/log/client.log\\nstdout_logfile_maxbytes=50MB\\n' > /etc/supervisor/conf.d/orca.conf"
+					ORCA_SUPERVISOR_CONFIG := "'[program:orca_client]\\ncommand=/orca/bin/orcahostd --interval 30 --hostid "+string(newHostId)+" --traineruri "+cloud.apiEndpoint+tokenArgument+"\\nautostart=true\\nautorestart=true\\nstartretries=2\\nuser=root\\nredirect_stderr=true\\nstdout_logfile=/orca/log/client.log\\nstdout_logfile_maxbytes=50MB\\n' > /etc/supervisor/conf.d/orca.conf"
 
 					instance := []string{
 						"echo orca | sudo -S addgroup --system supervisor",
@@ -70,6 +127,7 @@ func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 						"echo orca | sudo -S apt-get install -y git golang supervisor docker.io",
 						"echo orca | sudo -S sh -c \"echo " + SUPERVISOR_CONFIG + "\"",
 						"echo orca | sudo -S sh -c \"echo " + ORCA_SUPERVISOR_CONFIG + "\"",
+						"echo orca | sudo -S chmod 600 /etc/supervisor/conf.d/orca.conf",
 						"echo orca | sudo -S rm -rf /orca",
 						"echo orca | sudo -S mkdir -p /orca",
 						"echo orca | sudo -S mkdir -p /orca/apps",
@@ -82,7 +140,6 @@ func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 						"rm -rf /orca/src/bluewhale && mkdir -p /orca/src/bluewhale && cd /orca/src/bluewhale && git clone https://github.com/bluewhale/orcahostd.git",
 						"GOPATH=/orca bash -c 'cd /orca/src/bluewhale/orcahostd && go get github.com/Sirupsen/logrus && go get golang.org/x/crypto/ssh && go get github.com/fsouza/go-dockerclient && go get github.com/gorilla/mux'",
 						"GOPATH=/orca bash -c 'cd /orca/src/bluewhale/orcahostd && go build && go install'",
-						"echo orca | sudo -S service supervisor restart",
 					}
 
 					for _, cmd := range instance {
@@ -91,12 +148,37 @@ func (cloud* CloudProvider) ActionChange(change *model.ChangeServer){
 
 						}
 					}
+					for _, file := range files {
+						orcaSSh.WriteSshFile(session, addr, file.path, file.content)
+					}
+					orcaSSh.ExecuteSshCommand(session, addr, "echo orca | sudo -S service supervisor restart")
 
 					break
 				}
 
 				cloud.RemoveChange(change.Id)
+				events.PublishChange(string(newHostId), "", change.Id, change.Type, events.CHANGE_COMPLETED)
+				events.PlanningTrigger.Fire("new server " + string(newHostId) + " is ready")
+			} else {
+				events.PublishChange("", "", change.Id, change.Type, events.CHANGE_FAILED)
+				metrics.Trainer.Add("orca_spawn_failures_total", nil, 1)
+			}
+		}
+
+		if change.Type == "remove" {
+			if !cloud.Engine.TerminateInstance(HostId(change.HostId)) {
+				cloud.RemoveChange(change.Id)
+				events.PublishChange(change.HostId, "", change.Id, change.Type, events.CHANGE_FAILED)
+				return
+			}
+			if cloud.credentials != nil {
+				cloud.credentials.RevokeHost(change.HostId)
+			}
+			if cloud.certificates != nil {
+				cloud.certificates.RevokeHost(change.HostId)
 			}
+			cloud.RemoveChange(change.Id)
+			events.PublishChange(change.HostId, "", change.Id, change.Type, events.CHANGE_COMPLETED)
 		}
 	}()
 
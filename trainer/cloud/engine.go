@@ -9,6 +9,8 @@ type CloudEngine interface {
 	TerminateInstance(HostId) bool
 
 	GetIp(hostId HostId) string
+	/* Labels the planner can place applications by, e.g. the zone of the host */
+	GetLabels(hostId HostId) map[string]string
 
 	GetPem() string
 	//GetIp(HostId) base.IpAddr
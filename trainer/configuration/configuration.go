@@ -19,13 +19,15 @@ along with Orca.  If not, see <http://www.gnu.org/licenses/>.
 package configuration
 
 import (
+	"bytes"
 	"errors"
 	"os"
+	"regexp"
+	"sync"
 	"encoding/json"
 	"fmt"
 	"gatoor/orca/util"
 	Logger "gatoor/orca/trainer/logs"
-	"io/ioutil"
 	"gatoor/orca/trainer/state"
 	"gatoor/orca/trainer/model"
 )
@@ -35,53 +37,98 @@ type ConfigurationStore struct {
 	AuditDatabaseUri string;
 
 	trainerConfigurationFilePath string;
+	/* Previous versions of the configuration kept in the snapshot directory, 0 keeps none */
+	snapshots int;
+	/* Optional, one file per application */
+	applicationsDirectory string;
+	sources map[string]string;
+	/* The files as last loaded or saved, the watcher ignores the store's own writes */
+	lastContent []byte;
+	/* The whole configuration as last loaded or saved, becomes a snapshot when it changes */
+	lastConfiguration []byte;
+	/* Held by reloads, the api while it changes and saves an application and the planner while it reads. A pointer,
+	   the planners get the store by value */
+	lock *sync.RWMutex;
 }
 
 func (store *ConfigurationStore) Init(trainerConfigurationFilePath string){
+	store.lock = &sync.RWMutex{}
 	store.trainerConfigurationFilePath = trainerConfigurationFilePath
 	store.Configurations = make(map[string]*model.ApplicationConfiguration);
+	store.sources = make(map[string]string);
 }
 
 func (store *ConfigurationStore) DumpConfig(){
 	fmt.Printf("Loading config file from %+v", store.Configurations)
 }
 
-func (store* ConfigurationStore) Load(){
-	store.loadFromFile(store.trainerConfigurationFilePath)
+func (store *ConfigurationStore) WriteLock() {
+	store.lock.Lock()
+}
+
+func (store *ConfigurationStore) WriteUnlock() {
+	store.lock.Unlock()
+}
+
+func (store *ConfigurationStore) ReadLock() {
+	store.lock.RLock()
 }
 
-func (store* ConfigurationStore) Save(){
-	store.saveConfigToFile(store.trainerConfigurationFilePath)
+func (store *ConfigurationStore) ReadUnlock() {
+	store.lock.RUnlock()
 }
 
-func (store* ConfigurationStore) loadFromFile(filename string) {
-	Logger.InitLogger.Infof("Loading config file from %s", filename)
-	file, err := os.Open(filename)
+func (store* ConfigurationStore) Load(){
+	Logger.InitLogger.Infof("Loading config file from %s", store.trainerConfigurationFilePath)
+	loaded, err := store.readConfiguration()
 	if err != nil {
-		Logger.InitLogger.Fatalf("Could not open config file %s - %s", filename, err)
-		return
+		Logger.InitLogger.Fatalf("Invalid configuration:\n%s", err)
 	}
+	store.Configurations = loaded.configurations
+	store.AuditDatabaseUri = loaded.auditDatabaseUri
+	store.sources = loaded.sources
+	store.lastContent = loaded.content
+	store.lastConfiguration, _ = json.MarshalIndent(store, "", "  ")
+	Logger.InitLogger.Infof("Load done, %d applications, %d of them from their own file", len(store.Configurations), len(store.sources))
+}
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(store); err != nil {
-		extra := ""
-		if serr, ok := err.(*json.SyntaxError); ok {
-			line, col, highlight := util.HighlightBytePosition(file, serr.Offset)
-			extra = fmt.Sprintf(":\nError at line %d, column %d (file offset %d):\n%s",
-				line, col, serr.Offset, highlight)
+/* The configuration before the change is kept as a snapshot. The caller holds the lock since it made the change */
+func (store* ConfigurationStore) Save() error {
+	configuration, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not serialize the configuration - %s", err)
+	}
+	written, err := store.writeConfiguration()
+	if written {
+		store.lastContent = store.sourceContent()
+	}
+	if err != nil {
+		return err
+	}
+	if store.lastConfiguration != nil && !bytes.Equal(store.lastConfiguration, configuration) {
+		if err := store.snapshot(store.lastConfiguration); err != nil {
+			Logger.Logger.Errorf("Could not keep a snapshot of the configuration - %s", err)
 		}
-		Logger.InitLogger.Fatalf("error parsing JSON object in config file %s%s\n%v",
-			file.Name(), extra, err)
-	} else {
-		fmt.Sprintf("error: %v", err)
 	}
+	store.lastConfiguration = configuration
+	return nil
+}
 
-	Logger.InitLogger.Infof("Load done")
-	file.Close()
+/* Points to the field in the file where possible, indices like PortMappings[0] only lead to the list */
+func describeConfigurationError(filename string, content []byte, field string, verr FieldError) string {
+	offset := findFieldOffset(content, listIndex.ReplaceAllString(field, ""))
+	if offset < 0 {
+		return fmt.Sprintf("error in config file %s: %s", filename, verr)
+	}
+	line, col, highlight := util.HighlightBytePosition(bytes.NewReader(content), offset)
+	return fmt.Sprintf("error in config file %s: %s\nError at line %d, column %d (file offset %d):\n%s",
+		filename, verr, line, col, offset, highlight)
 }
 
-func (store* ConfigurationStore) Add(name string, config *model.ApplicationConfiguration) *model.ApplicationConfiguration{
-	state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+var listIndex = regexp.MustCompile(`\[\d+\]`)
+
+func (store* ConfigurationStore) Add(name string, config *model.ApplicationConfiguration, actor string) *model.ApplicationConfiguration{
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
 		"message": "Adding application " + name + " to orca",
 	}})
 
@@ -89,16 +136,66 @@ func (store* ConfigurationStore) Add(name string, config *model.ApplicationConfi
 	return config
 }
 
-func (store* ConfigurationStore) saveConfigToFile(filename string) {
-	res, err := json.MarshalIndent(store, "", "  ")
+/* The application stays in the store until the planner has removed all of its instances */
+func (store* ConfigurationStore) Decommission(name string, actor string) (*model.ApplicationConfiguration, error) {
+	app, ok := store.Configurations[name]
+	if !ok {
+		return nil, errors.New("Could not find application")
+	}
+
+	if !app.Decommission {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+			"message": "Decommissioning application " + name,
+			"application": name,
+		}})
+	}
+
+	app.Decommission = true
+	return app, nil
+}
+
+func (store* ConfigurationStore) Remove(name string, actor string) error {
+	if _, ok := store.Configurations[name]; !ok {
+		return errors.New("Could not find application")
+	}
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+		"message": "Removing application " + name + " from orca",
+		"application": name,
+	}})
+
+	delete(store.Configurations, name)
+	return nil
+}
+
+/* Synced so the rename never points to a file that is still only in the page cache */
+func writeAndSync(filename string, content []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
 	if err != nil {
-		Logger.InitLogger.Errorf("JsonConfiguration Derialize failed: %s; %+v", err, store)
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
 	}
-	var result = string(res)
-	err = ioutil.WriteFile(filename, []byte(result), 0644)
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/* A rename or a new file is only durable once the directory entry is synced too */
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
 	}
+	return dir.Close()
 }
 
 func (store *ConfigurationStore) GetConfiguration(application string) (*model.ApplicationConfiguration, error) {
@@ -0,0 +1,481 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"gopkg.in/yaml.v3"
+	"gatoor/orca/util"
+	"gatoor/orca/trainer/model"
+)
+
+/* Everything the configuration is read from, trainer.conf and the application files */
+type loadedConfiguration struct {
+	configurations   map[string]*model.ApplicationConfiguration
+	auditDatabaseUri string
+	/* Application name to the file in the applications directory, the others live in trainer.conf */
+	sources          map[string]string
+	content          []byte
+}
+
+/* Applications can also be kept one per file in a directory, as json (.json) or yaml (.yaml, .yml).
+   Has to be called before Load, a directory that doesn't exist is ignored */
+func (store *ConfigurationStore) UseApplicationsDirectory(directory string) {
+	store.applicationsDirectory = directory
+}
+
+func isYaml(filename string) bool {
+	extension := filepath.Ext(filename)
+	return extension == ".yaml" || extension == ".yml"
+}
+
+func (store *ConfigurationStore) applicationFiles() ([]string, error) {
+	if store.applicationsDirectory == "" {
+		return []string{}, nil
+	}
+	entries, err := ioutil.ReadDir(store.applicationsDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (extension != ".json" && !isYaml(entry.Name())) {
+			continue
+		}
+		files = append(files, filepath.Join(store.applicationsDirectory, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/* Reads and validates trainer.conf and the application files, nothing is changed in the store */
+func (store *ConfigurationStore) readConfiguration() (loadedConfiguration, error) {
+	loaded := loadedConfiguration{sources: make(map[string]string)}
+	files, err := store.applicationFiles()
+	if err != nil {
+		return loaded, fmt.Errorf("Could not read the applications directory %s - %s", store.applicationsDirectory, err)
+	}
+
+	/* trainer.conf may be left out when all applications have their own file */
+	filename := store.trainerConfigurationFilePath
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !(os.IsNotExist(err) && len(files) > 0) {
+		return loaded, fmt.Errorf("Could not open config file %s - %s", filename, err)
+	}
+	contents := map[string][]byte{filename: content}
+	trainerConfiguration := ConfigurationStore{}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &trainerConfiguration); err != nil {
+			return loaded, errors.New(describeParseError(filename, content, err))
+		}
+	}
+	loaded.configurations = trainerConfiguration.Configurations
+	if loaded.configurations == nil {
+		loaded.configurations = make(map[string]*model.ApplicationConfiguration)
+	}
+	loaded.auditDatabaseUri = trainerConfiguration.AuditDatabaseUri
+	loaded.content = append([]byte(filename + "\n"), content...)
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return loaded, err
+		}
+		contents[file] = content
+		loaded.content = append(append(loaded.content, []byte("\n" + file + "\n")...), content...)
+
+		application, err := decodeApplication(file, content)
+		if err != nil {
+			return loaded, err
+		}
+		/* The file name is the default for the application name */
+		if application.Name == "" {
+			application.Name = defaultName(file)
+		}
+		if _, exists := loaded.configurations[application.Name]; exists {
+			other := filename
+			if source, ok := loaded.sources[application.Name]; ok {
+				other = source
+			}
+			return loaded, errors.New("Application " + application.Name + " is defined in both " + other + " and " + file)
+		}
+		loaded.configurations[application.Name] = application
+		loaded.sources[application.Name] = file
+	}
+
+	if errs := ValidateConfigurations(loaded.configurations); len(errs) > 0 {
+		messages := []string{}
+		for _, verr := range errs {
+			/* Fields of applications with their own file are relative to it */
+			source, field := filename, verr.Field
+			for name, file := range loaded.sources {
+				if strings.HasPrefix(verr.Field, "Configurations." + name + ".") {
+					source, field = file, strings.TrimPrefix(verr.Field, "Configurations." + name + ".")
+					verr.Field = field
+				}
+			}
+			if isYaml(source) {
+				messages = append(messages, fmt.Sprintf("error in config file %s: %s", source, verr))
+				continue
+			}
+			messages = append(messages, describeConfigurationError(source, contents[source], field, verr))
+		}
+		return loaded, errors.New(strings.Join(messages, "\n"))
+	}
+	return loaded, nil
+}
+
+/* YAML goes through json so both formats use the same field names */
+func decodeApplication(filename string, content []byte) (*model.ApplicationConfiguration, error) {
+	if isYaml(filename) {
+		var document interface{}
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return nil, fmt.Errorf("error parsing YAML in config file %s - %s", filename, err)
+		}
+		converted, err := json.Marshal(stringKeys(document))
+		if err != nil {
+			return nil, fmt.Errorf("error converting YAML in config file %s - %s", filename, err)
+		}
+		content = converted
+	}
+	application := &model.ApplicationConfiguration{}
+	if err := json.Unmarshal(content, application); err != nil {
+		return nil, errors.New(describeParseError(filename, content, err))
+	}
+	if application.Config == nil {
+		application.Config = make(map[string]model.VersionConfig)
+	}
+	return application, nil
+}
+
+/* Only the fields that differ from what the file holds are written, comments, the order of the keys and fields that
+   were left out stay as they are. Files that can't be parsed anymore are replaced */
+func encodeApplication(filename string, content []byte, application *model.ApplicationConfiguration) ([]byte, error) {
+	var document yaml.Node
+	previous, err := decodeApplication(filename, content)
+	if err != nil || yaml.Unmarshal(content, &document) != nil || len(document.Content) == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{}}}
+		previous = nil
+	}
+	if previous != nil && previous.Name == "" {
+		previous.Name = defaultName(filename)
+	}
+
+	before, err := genericValue(previous)
+	if err != nil {
+		return nil, err
+	}
+	after, err := genericValue(application)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && reflect.DeepEqual(before, after) {
+		return content, nil
+	}
+	if err := patchNode(document.Content[0], before, after); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if !isYaml(filename) {
+		writeJsonNode(&buffer, document.Content[0])
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, buffer.Bytes(), "", "  "); err != nil {
+			return nil, err
+		}
+		return append(indented.Bytes(), '\n'), nil
+	}
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), encoder.Close()
+}
+
+func defaultName(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
+
+/* The application as maps and lists with the json field names, nil stays nil */
+func genericValue(application *model.ApplicationConfiguration) (interface{}, error) {
+	if application == nil {
+		return nil, nil
+	}
+	content, err := json.Marshal(application)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	return value, json.Unmarshal(content, &value)
+}
+
+/* Changes the node from what previous looks like to value, mappings are patched key by key */
+func patchNode(node *yaml.Node, previous interface{}, value interface{}) error {
+	if reflect.DeepEqual(previous, value) {
+		return nil
+	}
+	previousMap, wasMap := previous.(map[string]interface{})
+	valueMap, isMap := value.(map[string]interface{})
+	if wasMap && isMap && node.Kind == yaml.MappingNode {
+		keys := []string{}
+		for key := range valueMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if reflect.DeepEqual(previousMap[key], valueMap[key]) {
+				continue
+			}
+			if index := mappingIndex(node, key); index >= 0 {
+				if err := patchNode(node.Content[index + 1], previousMap[key], valueMap[key]); err != nil {
+					return err
+				}
+				continue
+			}
+			/* A struct that was left out only gets the fields that are set */
+			keyNode, valueNode := &yaml.Node{}, &yaml.Node{}
+			if _, ok := previousMap[key].(map[string]interface{}); ok {
+				valueNode = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			if err := keyNode.Encode(key); err != nil {
+				return err
+			}
+			if err := patchNode(valueNode, previousMap[key], valueMap[key]); err != nil {
+				return err
+			}
+			node.Content = append(node.Content, keyNode, valueNode)
+		}
+		for key := range previousMap {
+			if _, ok := valueMap[key]; ok {
+				continue
+			}
+			if index := mappingIndex(node, key); index >= 0 {
+				node.Content = append(node.Content[:index], node.Content[index + 2:]...)
+			}
+		}
+		return nil
+	}
+
+	replacement := yaml.Node{}
+	if err := replacement.Encode(value); err != nil {
+		return err
+	}
+	replacement.HeadComment, replacement.LineComment, replacement.FootComment = node.HeadComment, node.LineComment, node.FootComment
+	*node = replacement
+	return nil
+}
+
+/* Index of the key in the mapping, case insensitive like the json decoder. -1 if it's missing */
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i + 1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+/* JSON files are parsed as yaml too, this writes them back in their order */
+func writeJsonNode(buffer *bytes.Buffer, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		writeJsonNode(buffer, node.Content[0])
+	case yaml.MappingNode:
+		buffer.WriteString("{")
+		for i := 0; i + 1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			writeJsonString(buffer, node.Content[i].Value)
+			buffer.WriteString(":")
+			writeJsonNode(buffer, node.Content[i + 1])
+		}
+		buffer.WriteString("}")
+	case yaml.SequenceNode:
+		buffer.WriteString("[")
+		for i, entry := range node.Content {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			writeJsonNode(buffer, entry)
+		}
+		buffer.WriteString("]")
+	case yaml.AliasNode:
+		writeJsonNode(buffer, node.Alias)
+	default:
+		switch node.ShortTag() {
+		case "!!int", "!!float", "!!bool":
+			buffer.WriteString(node.Value)
+		case "!!null":
+			buffer.WriteString("null")
+		default:
+			writeJsonString(buffer, node.Value)
+		}
+	}
+}
+
+/* Without the html escaping of json.Marshal, untouched strings stay as they were */
+func writeJsonString(buffer *bytes.Buffer, value string) {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	buffer.Truncate(buffer.Len() - 1)
+}
+
+/* Mappings with keys that are not strings, e.g. unquoted version numbers, are decoded with interface{} keys, which json
+   can't encode */
+func stringKeys(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, entry := range typed {
+			converted[fmt.Sprint(key)] = stringKeys(entry)
+		}
+		return converted
+	case map[string]interface{}:
+		for key, entry := range typed {
+			typed[key] = stringKeys(entry)
+		}
+	case []interface{}:
+		for i, entry := range typed {
+			typed[i] = stringKeys(entry)
+		}
+	}
+	return value
+}
+
+func describeParseError(filename string, content []byte, err error) string {
+	extra := ""
+	if serr, ok := err.(*json.SyntaxError); ok {
+		line, col, highlight := util.HighlightBytePosition(bytes.NewReader(content), serr.Offset)
+		extra = fmt.Sprintf(":\nError at line %d, column %d (file offset %d):\n%s",
+			line, col, serr.Offset, highlight)
+	}
+	return fmt.Sprintf("error parsing JSON object in config file %s%s\n%v", filename, extra, err)
+}
+
+/* Writes the applications that have their own file back to it and the others to trainer.conf, files of applications
+   that are gone are removed. Only files whose content changed are written. Returns true if anything was written */
+func (store *ConfigurationStore) writeConfiguration() (bool, error) {
+	trainerConfiguration := ConfigurationStore{Configurations: make(map[string]*model.ApplicationConfiguration), AuditDatabaseUri: store.AuditDatabaseUri}
+	written := false
+	for name, application := range store.Configurations {
+		file, ok := store.sources[name]
+		if !ok {
+			trainerConfiguration.Configurations[name] = application
+			continue
+		}
+		previous, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return written, err
+		}
+		/* The file was removed, the application is decommissioned and must not come back */
+		if os.IsNotExist(err) && application.Decommission {
+			continue
+		}
+		content, err := encodeApplication(file, previous, application)
+		if err != nil {
+			return written, fmt.Errorf("Could not serialize application %s - %s", name, err)
+		}
+		changed, err := writeIfChanged(file, content)
+		if err != nil {
+			return written, err
+		}
+		written = written || changed
+	}
+
+	for name, file := range store.sources {
+		if _, ok := store.Configurations[name]; ok {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return written, err
+		}
+		if err := syncDirectory(filepath.Dir(file)); err != nil {
+			return written, err
+		}
+		delete(store.sources, name)
+		written = true
+	}
+
+	content, err := json.MarshalIndent(trainerConfiguration, "", "  ")
+	if err != nil {
+		return written, fmt.Errorf("Could not serialize the configuration - %s", err)
+	}
+	changed, err := writeIfChanged(store.trainerConfigurationFilePath, content)
+	return written || changed, err
+}
+
+/* Written to a temporary file and renamed, a crash leaves either the old or the new file. The directory is synced so the
+   rename survives the crash as well */
+func writeIfChanged(filename string, content []byte) (bool, error) {
+	previous, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(previous, content) {
+		return false, nil
+	}
+	tmpFile := filename + ".tmp"
+	if err := writeAndSync(tmpFile, content); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFile, filename); err != nil {
+		return false, err
+	}
+	return true, syncDirectory(filepath.Dir(filename))
+}
+
+/* Raw content of all files the configuration is read from, the watcher ignores the store's own writes by comparing it */
+func (store *ConfigurationStore) sourceContent() []byte {
+	content, _ := ioutil.ReadFile(store.trainerConfigurationFilePath)
+	all := append([]byte(store.trainerConfigurationFilePath + "\n"), content...)
+	files, _ := store.applicationFiles()
+	for _, file := range files {
+		content, _ := ioutil.ReadFile(file)
+		all = append(append(all, []byte("\n" + file + "\n")...), content...)
+	}
+	return all
+}
+
+/* Changes whenever one of the files is written, added or removed */
+func (store *ConfigurationStore) sourceModification() string {
+	files, _ := store.applicationFiles()
+	signature := []string{}
+	for _, file := range append([]string{store.trainerConfigurationFilePath}, files...) {
+		if info, err := os.Stat(file); err == nil {
+			signature = append(signature, fmt.Sprintf("%s %d %d", file, info.ModTime().UnixNano(), info.Size()))
+		}
+	}
+	return strings.Join(signature, "\n")
+}
@@ -0,0 +1,202 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const webYaml = `# the web frontend
+MinDeployment: 1 # at least one
+DesiredDeployment: 2
+Config:
+  1:
+    Version: "1"
+    DockerConfig:
+      Repository: nginx
+`
+
+const webJson = `{
+  "Name": "web",
+  "MinDeployment": 1,
+  "DesiredDeployment": 2,
+  "Config": {
+    "1": {
+      "Version": "1",
+      "DockerConfig": {
+        "Repository": "nginx"
+      }
+    }
+  }
+}
+`
+
+/* Files in the applications directory next to trainer.conf */
+func applicationsStore(t *testing.T, dir string, trainerConfiguration string, files map[string]string) *ConfigurationStore {
+	os.MkdirAll(filepath.Join(dir, "applications"), 0755)
+	if trainerConfiguration != "" {
+		ioutil.WriteFile(filepath.Join(dir, "trainer.conf"), []byte(trainerConfiguration), 0644)
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, "applications", name), []byte(content), 0644)
+	}
+	store := &ConfigurationStore{}
+	store.Init(filepath.Join(dir, "trainer.conf"))
+	store.UseApplicationsDirectory(filepath.Join(dir, "applications"))
+	return store
+}
+
+func TestReadConfiguration(t *testing.T) {
+	tests := []struct {
+		name                 string
+		trainerConfiguration string
+		files                map[string]string
+		sources              map[string]string
+		err                  string
+	}{
+		{"yaml named after the file", "", map[string]string{"web.yaml": webYaml}, map[string]string{"web": "web.yaml"}, ""},
+		{"json and yml", "", map[string]string{"frontend.json": webJson, "api.yml": webYaml}, map[string]string{"web": "frontend.json", "api": "api.yml"}, ""},
+		{"trainer.conf and files", `{"Configurations": {"db": {"MinDeployment": 1, "DesiredDeployment": 1, "Config": {}}}}`,
+			map[string]string{"web.yaml": webYaml}, map[string]string{"web": "web.yaml"}, ""},
+		{"other files are ignored", "", map[string]string{"web.yaml": webYaml, "notes.txt": "{", ".hidden.json": "{"}, map[string]string{"web": "web.yaml"}, ""},
+		{"duplicate in two files", "", map[string]string{"web.yaml": webYaml, "frontend.json": webJson}, nil, "is defined in both"},
+		{"duplicate in trainer.conf", `{"Configurations": {"web": {"Config": {}}}}`, map[string]string{"web.yaml": webYaml}, nil, "is defined in both"},
+		{"invalid yaml", "", map[string]string{"web.yaml": "Config: [\n"}, nil, "error parsing YAML in config file"},
+		{"invalid json", "", map[string]string{"web.json": "{"}, nil, "error parsing JSON object in config file"},
+		{"invalid application", "", map[string]string{"web.yaml": strings.Replace(webYaml, "MinDeployment: 1", "MinDeployment: -1", 1)}, nil, "web.yaml"},
+		{"no files and no trainer.conf", "", map[string]string{}, nil, "Could not open config file"},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		store := applicationsStore(t, dir, test.trainerConfiguration, test.files)
+
+		loaded, err := store.readConfiguration()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		sources := make(map[string]string)
+		for name, file := range loaded.sources {
+			sources[name] = filepath.Base(file)
+			if loaded.configurations[name].Name != name {
+				t.Errorf("%s: expected the application %s to be named after its file, got %s", test.name, name, loaded.configurations[name].Name)
+			}
+		}
+		if !reflect.DeepEqual(sources, test.sources) {
+			t.Errorf("%s: expected the sources %v, got %v", test.name, test.sources, sources)
+		}
+	}
+}
+
+func TestEncodeApplication(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		change   func(store *ConfigurationStore)
+		expected string
+	}{
+		{"unchanged yaml", "web.yaml", webYaml, func(store *ConfigurationStore) {}, webYaml},
+		{"unchanged json", "web.json", webJson, func(store *ConfigurationStore) {}, webJson},
+		{"yaml field", "web.yaml", webYaml, func(store *ConfigurationStore) {
+			store.Configurations["web"].DesiredDeployment = 3
+		}, strings.Replace(webYaml, "DesiredDeployment: 2", "DesiredDeployment: 3", 1)},
+		{"yaml field with a comment", "web.yaml", webYaml, func(store *ConfigurationStore) {
+			store.Configurations["web"].MinDeployment = 2
+		}, strings.Replace(webYaml, "MinDeployment: 1", "MinDeployment: 2", 1)},
+		{"nested yaml field", "web.yaml", webYaml, func(store *ConfigurationStore) {
+			config := store.Configurations["web"].Config["1"]
+			config.DockerConfig.Repository = "httpd"
+			store.Configurations["web"].Config["1"] = config
+		}, strings.Replace(webYaml, "nginx", "httpd", 1)},
+		{"json field", "web.json", webJson, func(store *ConfigurationStore) {
+			store.Configurations["web"].DesiredDeployment = 3
+		}, strings.Replace(webJson, `"DesiredDeployment": 2`, `"DesiredDeployment": 3`, 1)},
+		{"struct left out", "web.yaml", webYaml, func(store *ConfigurationStore) {
+			store.Configurations["web"].Placement.SpreadZones = true
+		}, webYaml + "Placement:\n  SpreadZones: true\n"},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		store := applicationsStore(t, dir, "", map[string]string{test.filename: test.content})
+		store.Load()
+		test.change(store)
+
+		if err := store.Save(); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		content, _ := ioutil.ReadFile(filepath.Join(dir, "applications", test.filename))
+		if string(content) != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, content)
+		}
+	}
+}
+
+func TestEncodeApplicationReplacesInvalidFile(t *testing.T) {
+	application := testApplication("web")
+	content, err := encodeApplication("web.yaml", []byte("Config: [\n"), application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeApplication("web.yaml", content)
+	if err != nil || !reflect.DeepEqual(decoded, application) {
+		t.Errorf("expected the application to be written in full, got %v %v", decoded, err)
+	}
+}
+
+func TestWriteConfigurationRemovesFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := applicationsStore(t, dir, "", map[string]string{"web.yaml": webYaml, "api.json": strings.Replace(webJson, `"web"`, `"api"`, 1)})
+	store.Load()
+
+	webFile := filepath.Join(dir, "applications", "web.yaml")
+	apiFile := filepath.Join(dir, "applications", "api.json")
+	delete(store.Configurations, "web")
+	store.Configurations["api"].Decommission = true
+	os.Remove(apiFile)
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(webFile); !os.IsNotExist(err) {
+		t.Error("expected the file of the removed application to be deleted")
+	}
+	if _, err := os.Stat(apiFile); !os.IsNotExist(err) {
+		t.Error("expected the decommissioned application not to be written back")
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "trainer.conf"))
+	if strings.Contains(string(content), "nginx") {
+		t.Errorf("expected the applications to stay out of trainer.conf, got %s", content)
+	}
+}
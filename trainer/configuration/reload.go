@@ -0,0 +1,218 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+var ReloadLogger = Logger.LoggerWithField(Logger.Logger, "module", "configuration")
+
+/* Reloads trainer.conf and the application files when they change on disk, checked every interval (0 disables polling)
+   and on SIGHUP.
+   Runs until the trainer stops */
+func (store *ConfigurationStore) Watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticks = time.NewTicker(interval).C
+	}
+
+	go func() {
+		lastModified := store.sourceModification()
+		for {
+			select {
+			case <-hangup:
+				ReloadLogger.Infof("Received SIGHUP, reloading %s", store.trainerConfigurationFilePath)
+			case <-ticks:
+				modified := store.sourceModification()
+				if modified == lastModified {
+					continue
+				}
+				lastModified = modified
+			}
+			store.reloadAndPlan()
+		}
+	}()
+}
+
+func (store *ConfigurationStore) reloadAndPlan() {
+	changed, err := store.Reload()
+	if err != nil {
+		ReloadLogger.Errorf("Keeping the current configuration - %s", err)
+		return
+	}
+	if changed {
+		events.PlanningTrigger.Fire("configuration reloaded")
+	}
+}
+
+/* Validates the files and swaps in the applications that changed under the lock, the others keep their objects. Applications
+   that are no longer in any file are decommissioned like a DELETE through the api. Returns false if nothing changed,
+   e.g. because the files were written by the store itself */
+func (store *ConfigurationStore) Reload() (bool, error) {
+	store.WriteLock()
+	defer store.WriteUnlock()
+
+	if bytes.Equal(store.sourceContent(), store.lastContent) {
+		return false, nil
+	}
+	loaded, err := store.readConfiguration()
+	if err != nil {
+		return false, err
+	}
+
+	current := store.Configurations
+	merged := make(map[string]*model.ApplicationConfiguration)
+	changes := []reloadChange{}
+	for _, name := range sortedNames(loaded.configurations, current) {
+		application, inFile := loaded.configurations[name]
+		previous, exists := current[name]
+		/* Removed files keep their source until the application is gone, it would move to trainer.conf otherwise */
+		if file, ok := store.sources[name]; ok && !inFile {
+			loaded.sources[name] = file
+		}
+		switch {
+		case !inFile && previous.Decommission:
+			merged[name] = previous
+		case !inFile:
+			decommissioned := *previous
+			decommissioned.Decommission = true
+			merged[name] = &decommissioned
+			changes = append(changes, reloadChange{name, "Decommissioning application " + name + ", it was removed from " + store.source(name)})
+		case !exists:
+			merged[name] = application
+			changes = append(changes, reloadChange{name, "Added application " + name + " from " + loaded.source(name, store.trainerConfigurationFilePath)})
+		case reflect.DeepEqual(previous, application):
+			merged[name] = previous
+		default:
+			merged[name] = application
+			changes = append(changes, reloadChange{name, "Changed application " + name + " in " + loaded.source(name, store.trainerConfigurationFilePath) + ": " + describeChanges(previous, application)})
+		}
+	}
+
+	if store.lastConfiguration != nil && len(changes) > 0 {
+		if err := store.snapshot(store.lastConfiguration); err != nil {
+			ReloadLogger.Errorf("Could not keep a snapshot of the configuration - %s", err)
+		}
+	}
+	store.Configurations = merged
+	store.AuditDatabaseUri = loaded.auditDatabaseUri
+	store.sources = loaded.sources
+	store.lastContent = loaded.content
+	store.lastConfiguration, _ = json.MarshalIndent(store, "", "  ")
+
+	for _, change := range changes {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+			"message": change.message,
+			"application": change.application,
+		}})
+	}
+	ReloadLogger.Infof("Reloaded the configuration, %d applications changed", len(changes))
+	return len(changes) > 0, nil
+}
+
+/* The file an application was read from */
+func (loaded loadedConfiguration) source(name string, trainerConfiguration string) string {
+	if file, ok := loaded.sources[name]; ok {
+		return file
+	}
+	return trainerConfiguration
+}
+
+func (store *ConfigurationStore) source(name string) string {
+	if file, ok := store.sources[name]; ok {
+		return file
+	}
+	return store.trainerConfigurationFilePath
+}
+
+type reloadChange struct {
+	application string
+	message     string
+}
+
+func sortedNames(first map[string]*model.ApplicationConfiguration, second map[string]*model.ApplicationConfiguration) []string {
+	names := []string{}
+	for name := range first {
+		names = append(names, name)
+	}
+	for name := range second {
+		if _, ok := first[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* e.g. "versions added 4, changed 3; MinDeployment, Placement" */
+func describeChanges(previous *model.ApplicationConfiguration, application *model.ApplicationConfiguration) string {
+	added, changed, removed := []string{}, []string{}, []string{}
+	for version, config := range application.Config {
+		if old, ok := previous.Config[version]; !ok {
+			added = append(added, version)
+		} else if !reflect.DeepEqual(old, config) {
+			changed = append(changed, version)
+		}
+	}
+	for version := range previous.Config {
+		if _, ok := application.Config[version]; !ok {
+			removed = append(removed, version)
+		}
+	}
+
+	parts := []string{}
+	for _, versions := range []struct {
+		label    string
+		versions []string
+	}{{"added", added}, {"changed", changed}, {"removed", removed}} {
+		if len(versions.versions) > 0 {
+			sort.Strings(versions.versions)
+			parts = append(parts, "versions " + versions.label + " " + strings.Join(versions.versions, ", "))
+		}
+	}
+
+	fields := []string{}
+	previousValue, value := reflect.ValueOf(*previous), reflect.ValueOf(*application)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		if name != "Config" && !reflect.DeepEqual(previousValue.Field(i).Interface(), value.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	if len(fields) > 0 {
+		parts = append(parts, strings.Join(fields, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,467 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"gatoor/orca/util"
+	"gatoor/orca/trainer/auth"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+type AwsSettings struct {
+	AccessKeyId     string
+	AccessKeySecret string
+	Region          string
+	BaseAmi         string
+	SshKey          string
+	SshKeyPath      string
+	SecurityGroupId string
+	Subnets         []string
+	UsePrivateIp    bool
+	InstanceProfile string
+	RootVolumeSize  int64
+}
+
+type CloudProviderSettings struct {
+	Type             string
+	InstanceUsername string
+	Aws              AwsSettings
+}
+
+type PlannerSettings struct {
+	Name       string
+	/* auto, paused or approve, the mode the cluster starts in */
+	Mode       string
+	Parameters map[string]string
+}
+
+type AuditSettings struct {
+	/* "mongo" or "none" */
+	Backend     string
+	DatabaseUri string
+}
+
+type TlsSettings struct {
+	/* TLS is enabled when a certificate is configured */
+	CertFile   string
+	KeyFile    string
+	/* Host agents authenticate with client certificates issued by the trainer CA */
+	MutualTls  bool
+	/* Created on first start if missing, default to ca.crt and ca.key in the configuration root */
+	CaCertFile string
+	CaKeyFile  string
+}
+
+type ApiSettings struct {
+	ListenAddress string
+	/* The uri the hosts use to reach the trainer */
+	PublicUri     string
+	Tls           TlsSettings
+}
+
+type AuthSettings struct {
+	/* Disabled means anyone who can reach the api is an operator and hosts can check in as any host */
+	Enabled        bool
+	Operators      []auth.OperatorToken
+	/* Hashes of the tokens issued to hosts, defaults to hosttokens.json in the configuration root */
+	HostTokensFile string
+}
+
+type MetricsHistorySettings struct {
+	/* Checkins kept as they are, with a checkin every 30 seconds the default covers three hours */
+	RawSamples             int
+	/* Older samples are averaged into buckets of this size */
+	BucketSeconds          int
+	Buckets                int
+	/* Persisting is disabled without a file */
+	PersistFile            string
+	PersistIntervalSeconds int
+}
+
+type LoadBalancerOutputSettings struct {
+	/* "haproxy" or "nginx" */
+	Format        string
+	/* Only this load balancer, all of them if empty */
+	LoadBalancer  string
+	File          string
+	ReloadCommand string
+}
+
+type SecretsSettings struct {
+	/* Both default to the configuration root, secrets.json and secrets.key. The key file is created on first start */
+	File          string
+	MasterKeyFile string
+	/* Base64, takes precedence over the key file. Better supplied through the environment than the settings file */
+	MasterKey     string
+}
+
+type TrainerSettings struct {
+	CloudProvider  string
+	CloudProviders map[string]CloudProviderSettings
+	Planner        PlannerSettings
+
+	PlanningIntervalSeconds           int
+	/* Events arriving within this window cause a single planning run */
+	PlanningDebounceMilliseconds      int
+	MaxElapsedTimeForAppChangeSeconds int
+	/* Hosts that did not check in for this long are marked lost */
+	HostLostAfterSeconds              int
+	/* Instances behind a load balancer are taken out of it this long before they are removed */
+	ConnectionDrainSeconds            int
+	/* Previous versions of trainer.conf kept in snapshots/ of the configuration root, 0 keeps none */
+	ConfigurationSnapshots            int
+	/* How often trainer.conf and the application files are checked for changes on disk, 0 only reloads on SIGHUP */
+	ConfigurationReloadSeconds        int
+	/* One json or yaml file per application, defaults to applications/ in the configuration root */
+	ApplicationsDirectory             string
+
+	Audit          AuditSettings
+	Api            ApiSettings
+	Auth           AuthSettings
+	MetricsHistory MetricsHistorySettings
+	Secrets        SecretsSettings
+	/* The backend pools are always available through the api, these write them to files as well */
+	LoadBalancerOutputs []LoadBalancerOutputSettings
+}
+
+type SettingsError struct {
+	Field   string
+	Message string
+}
+
+func (err SettingsError) Error() string {
+	return err.Field + ": " + err.Message
+}
+
+/* What --instanceusername used to default to */
+const DEFAULT_INSTANCE_USERNAME = "ubuntu"
+
+var KnownPlanners = []string{"boringplanner", "diffplan"}
+var KnownCloudProviders = []string{"aws"}
+
+func DefaultTrainerSettings() TrainerSettings {
+	return TrainerSettings{
+		CloudProvider: "aws",
+		CloudProviders: map[string]CloudProviderSettings{},
+		Planner: PlannerSettings{Name: "boringplanner", Mode: "auto", Parameters: map[string]string{}},
+		PlanningIntervalSeconds: 10,
+		PlanningDebounceMilliseconds: 500,
+		MaxElapsedTimeForAppChangeSeconds: 120,
+		HostLostAfterSeconds: 120,
+		ConnectionDrainSeconds: 30,
+		ConfigurationSnapshots: 20,
+		ConfigurationReloadSeconds: 5,
+		Audit: AuditSettings{Backend: "mongo"},
+		Api: ApiSettings{ListenAddress: ":5001", PublicUri: "http://localhost:5001"},
+		MetricsHistory: MetricsHistorySettings{RawSamples: 360, BucketSeconds: 300, Buckets: 288, PersistIntervalSeconds: 300},
+	}
+}
+
+/* Loads the settings file, applies the ORCA_* environment overrides and validates the result.
+   A missing file is not an error, everything can be supplied through the environment */
+func LoadTrainerSettings(filename string) (TrainerSettings, error) {
+	settings := DefaultTrainerSettings()
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return settings, fmt.Errorf("Could not open settings file %s - %s", filename, err)
+	}
+
+	if err == nil {
+		Logger.InitLogger.Infof("Loading settings file from %s", filename)
+		if err := json.Unmarshal(content, &settings); err != nil {
+			var offset int64 = -1
+			if serr, ok := err.(*json.SyntaxError); ok {
+				offset = serr.Offset
+			} else if terr, ok := err.(*json.UnmarshalTypeError); ok {
+				offset = terr.Offset
+			}
+			return settings, errors.New(describeSettingsError(filename, content, offset, err.Error()))
+		}
+	} else {
+		Logger.InitLogger.Infof("No settings file at %s, using defaults and environment", filename)
+	}
+
+	/* The type defaults to the name of the entry, {"aws": {...}} is enough */
+	for name, provider := range settings.CloudProviders {
+		if provider.Type == "" {
+			provider.Type = name
+			settings.CloudProviders[name] = provider
+		}
+	}
+
+	if err := settings.applyEnvironment(); err != nil {
+		return settings, err
+	}
+	settings.applyProviderDefaults()
+
+	validationErrors := settings.Validate()
+	if len(validationErrors) > 0 {
+		messages := []string{}
+		for _, verr := range validationErrors {
+			messages = append(messages, describeSettingsError(filename, content, findFieldOffset(content, verr.Field), verr.Error()))
+		}
+		return settings, errors.New(strings.Join(messages, "\n"))
+	}
+
+	return settings, nil
+}
+
+func (settings *TrainerSettings) ActiveCloudProvider() CloudProviderSettings {
+	return settings.CloudProviders[settings.CloudProvider]
+}
+
+func (settings *TrainerSettings) Validate() []SettingsError {
+	errs := []SettingsError{}
+
+	if !contains(KnownPlanners, settings.Planner.Name) {
+		errs = append(errs, SettingsError{"Planner.Name", "unknown planner " + strconv.Quote(settings.Planner.Name) + ", expected one of " + strings.Join(KnownPlanners, ", ")})
+	}
+	if value, ok := settings.Planner.Parameters["MinimumFleetSize"]; ok {
+		if number, err := strconv.Atoi(value); err != nil || number < 0 {
+			errs = append(errs, SettingsError{"Planner.Parameters.MinimumFleetSize", "must be a whole number that is not negative"})
+		}
+	}
+	for _, parameter := range []string{"HostCpuCapacity", "HostMemoryCapacity", "HostNetworkCapacity"} {
+		value, ok := settings.Planner.Parameters[parameter]
+		if !ok {
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err != nil || number < 0 {
+			errs = append(errs, SettingsError{"Planner.Parameters." + parameter, "must be a number that is not negative"})
+		}
+	}
+	if settings.Planner.Mode != "auto" && settings.Planner.Mode != "paused" && settings.Planner.Mode != "approve" {
+		errs = append(errs, SettingsError{"Planner.Mode", "must be auto, paused or approve"})
+	}
+	if settings.PlanningIntervalSeconds <= 0 {
+		errs = append(errs, SettingsError{"PlanningIntervalSeconds", "must be greater than 0"})
+	}
+	if settings.PlanningDebounceMilliseconds < 0 {
+		errs = append(errs, SettingsError{"PlanningDebounceMilliseconds", "must not be negative"})
+	}
+	if settings.MaxElapsedTimeForAppChangeSeconds <= 0 {
+		errs = append(errs, SettingsError{"MaxElapsedTimeForAppChangeSeconds", "must be greater than 0"})
+	}
+	if settings.HostLostAfterSeconds <= 0 {
+		errs = append(errs, SettingsError{"HostLostAfterSeconds", "must be greater than 0"})
+	}
+	if settings.ConnectionDrainSeconds < 0 {
+		errs = append(errs, SettingsError{"ConnectionDrainSeconds", "must not be negative"})
+	}
+	if settings.ConfigurationSnapshots < 0 {
+		errs = append(errs, SettingsError{"ConfigurationSnapshots", "must not be negative"})
+	}
+	if settings.ConfigurationReloadSeconds < 0 {
+		errs = append(errs, SettingsError{"ConfigurationReloadSeconds", "must not be negative"})
+	}
+	if settings.MetricsHistory.RawSamples <= 0 || settings.MetricsHistory.Buckets <= 0 {
+		errs = append(errs, SettingsError{"MetricsHistory", "RawSamples and Buckets must be greater than 0"})
+	}
+	if settings.MetricsHistory.BucketSeconds <= 0 {
+		errs = append(errs, SettingsError{"MetricsHistory.BucketSeconds", "must be greater than 0"})
+	}
+	if settings.MetricsHistory.PersistFile != "" && settings.MetricsHistory.PersistIntervalSeconds <= 0 {
+		errs = append(errs, SettingsError{"MetricsHistory.PersistIntervalSeconds", "must be greater than 0"})
+	}
+	for i, output := range settings.LoadBalancerOutputs {
+		if output.Format != "haproxy" && output.Format != "nginx" {
+			errs = append(errs, SettingsError{"LoadBalancerOutputs", "output " + strconv.Itoa(i) + " has to have the format haproxy or nginx"})
+		}
+		if output.File == "" {
+			errs = append(errs, SettingsError{"LoadBalancerOutputs", "output " + strconv.Itoa(i) + " needs a File"})
+		}
+	}
+	if settings.Audit.Backend != "mongo" && settings.Audit.Backend != "none" {
+		errs = append(errs, SettingsError{"Audit.Backend", "must be mongo or none"})
+	}
+	if settings.Api.ListenAddress == "" {
+		errs = append(errs, SettingsError{"Api.ListenAddress", "must not be empty"})
+	}
+	if settings.Api.PublicUri == "" {
+		errs = append(errs, SettingsError{"Api.PublicUri", "must not be empty"})
+	}
+	if (settings.Api.Tls.CertFile == "") != (settings.Api.Tls.KeyFile == "") {
+		errs = append(errs, SettingsError{"Api.Tls", "CertFile and KeyFile have to be set together"})
+	}
+	if settings.Api.Tls.MutualTls && settings.Api.Tls.CertFile == "" {
+		errs = append(errs, SettingsError{"Api.Tls.MutualTls", "requires CertFile and KeyFile"})
+	}
+	if settings.Api.Tls.CertFile != "" && !strings.HasPrefix(settings.Api.PublicUri, "https://") {
+		errs = append(errs, SettingsError{"Api.PublicUri", "must be an https uri when TLS is enabled"})
+	}
+	if settings.Auth.Enabled && len(settings.Auth.Operators) == 0 {
+		errs = append(errs, SettingsError{"Auth.Operators", "at least one operator is required when authentication is enabled"})
+	}
+	for i, operator := range settings.Auth.Operators {
+		if operator.Name == "" || len(operator.Token) < 16 {
+			errs = append(errs, SettingsError{"Auth.Operators", "operator " + strconv.Itoa(i) + " needs a name and a token of at least 16 characters"})
+		}
+	}
+
+	provider, ok := settings.CloudProviders[settings.CloudProvider]
+	if !ok {
+		errs = append(errs, SettingsError{"CloudProvider", "no settings for cloud provider " + strconv.Quote(settings.CloudProvider) + " in CloudProviders"})
+		return errs
+	}
+	if !contains(KnownCloudProviders, provider.Type) {
+		errs = append(errs, SettingsError{"CloudProviders." + settings.CloudProvider + ".Type", "unknown cloud provider type " + strconv.Quote(provider.Type)})
+	}
+	if provider.InstanceUsername == "" {
+		errs = append(errs, SettingsError{"CloudProviders." + settings.CloudProvider + ".InstanceUsername", "must not be empty"})
+	}
+	if provider.Type == "aws" {
+		prefix := "CloudProviders." + settings.CloudProvider + ".Aws."
+		required := map[string]string{
+			"AccessKeyId": provider.Aws.AccessKeyId,
+			"AccessKeySecret": provider.Aws.AccessKeySecret,
+			"Region": provider.Aws.Region,
+			"BaseAmi": provider.Aws.BaseAmi,
+			"SshKey": provider.Aws.SshKey,
+			"SshKeyPath": provider.Aws.SshKeyPath,
+			"SecurityGroupId": provider.Aws.SecurityGroupId,
+		}
+		for _, field := range []string{"AccessKeyId", "AccessKeySecret", "Region", "BaseAmi", "SshKey", "SshKeyPath", "SecurityGroupId"} {
+			if required[field] == "" {
+				errs = append(errs, SettingsError{prefix + field, "must not be empty"})
+			}
+		}
+		if provider.Aws.RootVolumeSize < 0 {
+			errs = append(errs, SettingsError{prefix + "RootVolumeSize", "must not be negative"})
+		}
+	}
+
+	return errs
+}
+
+/* The providers come from the file or the environment, so their defaults can't be part of DefaultTrainerSettings */
+func (settings *TrainerSettings) applyProviderDefaults() {
+	for name, provider := range settings.CloudProviders {
+		if provider.InstanceUsername == "" {
+			provider.InstanceUsername = DEFAULT_INSTANCE_USERNAME
+			settings.CloudProviders[name] = provider
+		}
+	}
+}
+
+/* Environment overrides, mostly so credentials don't have to live in the settings file */
+func (settings *TrainerSettings) applyEnvironment() error {
+	provider := settings.CloudProviders[settings.CloudProvider]
+	providerChanged := false
+
+	overrides := []struct {
+		name  string
+		apply func(value string) error
+	}{
+		{"ORCA_CLOUD_PROVIDER", func(value string) error { settings.CloudProvider = value; provider = settings.CloudProviders[value]; return nil }},
+		{"ORCA_INSTANCE_USERNAME", func(value string) error { provider.InstanceUsername = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_ACCESS_KEY_ID", func(value string) error { provider.Aws.AccessKeyId = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_ACCESS_KEY_SECRET", func(value string) error { provider.Aws.AccessKeySecret = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_REGION", func(value string) error { provider.Aws.Region = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_BASE_AMI", func(value string) error { provider.Aws.BaseAmi = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_SSH_KEY", func(value string) error { provider.Aws.SshKey = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_SSH_KEY_PATH", func(value string) error { provider.Aws.SshKeyPath = value; providerChanged = true; return nil }},
+		{"ORCA_AWS_SECURITY_GROUP_ID", func(value string) error { provider.Aws.SecurityGroupId = value; providerChanged = true; return nil }},
+		{"ORCA_PLANNER", func(value string) error { settings.Planner.Name = value; return nil }},
+		{"ORCA_PLANNER_MODE", func(value string) error { settings.Planner.Mode = value; return nil }},
+		{"ORCA_PLANNING_INTERVAL", func(value string) (err error) { settings.PlanningIntervalSeconds, err = strconv.Atoi(value); return }},
+		{"ORCA_PLANNING_DEBOUNCE", func(value string) (err error) { settings.PlanningDebounceMilliseconds, err = strconv.Atoi(value); return }},
+		{"ORCA_MAX_ELAPSED_TIME_FOR_APP_CHANGE", func(value string) (err error) { settings.MaxElapsedTimeForAppChangeSeconds, err = strconv.Atoi(value); return }},
+		{"ORCA_HOST_LOST_AFTER", func(value string) (err error) { settings.HostLostAfterSeconds, err = strconv.Atoi(value); return }},
+		{"ORCA_CONNECTION_DRAIN", func(value string) (err error) { settings.ConnectionDrainSeconds, err = strconv.Atoi(value); return }},
+		{"ORCA_CONFIGURATION_RELOAD", func(value string) (err error) { settings.ConfigurationReloadSeconds, err = strconv.Atoi(value); return }},
+		{"ORCA_APPLICATIONS_DIRECTORY", func(value string) error { settings.ApplicationsDirectory = value; return nil }},
+		{"ORCA_AUDIT_BACKEND", func(value string) error { settings.Audit.Backend = value; return nil }},
+		{"ORCA_AUDIT_DATABASE_URI", func(value string) error { settings.Audit.DatabaseUri = value; return nil }},
+		{"ORCA_METRICS_HISTORY_FILE", func(value string) error { settings.MetricsHistory.PersistFile = value; return nil }},
+		{"ORCA_SECRETS_MASTER_KEY", func(value string) error { settings.Secrets.MasterKey = value; return nil }},
+		{"ORCA_API_LISTEN_ADDRESS", func(value string) error { settings.Api.ListenAddress = value; return nil }},
+		{"ORCA_API_PUBLIC_URI", func(value string) error { settings.Api.PublicUri = value; return nil }},
+		{"ORCA_TLS_CERT_FILE", func(value string) error { settings.Api.Tls.CertFile = value; return nil }},
+		{"ORCA_TLS_KEY_FILE", func(value string) error { settings.Api.Tls.KeyFile = value; return nil }},
+		{"ORCA_MUTUAL_TLS", func(value string) (err error) { settings.Api.Tls.MutualTls, err = strconv.ParseBool(value); return }},
+		{"ORCA_AUTH_ENABLED", func(value string) (err error) { settings.Auth.Enabled, err = strconv.ParseBool(value); return }},
+		{"ORCA_OPERATOR_TOKEN", func(value string) error {
+			settings.Auth.Operators = append(settings.Auth.Operators, auth.OperatorToken{Name: "admin", Token: value})
+			return nil
+		}},
+	}
+
+	for _, override := range overrides {
+		value, ok := os.LookupEnv(override.name)
+		if !ok {
+			continue
+		}
+		if err := override.apply(value); err != nil {
+			return fmt.Errorf("Invalid value for environment variable %s - %s", override.name, err)
+		}
+		Logger.InitLogger.Infof("Setting overridden by environment variable %s", override.name)
+	}
+
+	if providerChanged {
+		if provider.Type == "" {
+			provider.Type = settings.CloudProvider
+		}
+		settings.CloudProviders[settings.CloudProvider] = provider
+	}
+	return nil
+}
+
+func describeSettingsError(filename string, content []byte, offset int64, message string) string {
+	if offset < 0 {
+		return fmt.Sprintf("error in settings file %s: %s", filename, message)
+	}
+	line, col, highlight := util.HighlightBytePosition(bytes.NewReader(content), offset)
+	return fmt.Sprintf("error in settings file %s: %s\nError at line %d, column %d (file offset %d):\n%s",
+		filename, message, line, col, offset, highlight)
+}
+
+/* Best effort lookup of a dotted field path like CloudProviders.aws.Region in the raw file, -1 if the
+   field is not in the file (e.g. it is missing, which is usually what the validation complains about) */
+func findFieldOffset(content []byte, field string) int64 {
+	if len(content) == 0 {
+		return -1
+	}
+	offset := 0
+	for _, part := range strings.Split(field, ".") {
+		idx := bytes.Index(content[offset:], []byte(strconv.Quote(part)))
+		if idx < 0 {
+			return -1
+		}
+		offset += idx + len(part) + 2
+	}
+	return int64(offset)
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
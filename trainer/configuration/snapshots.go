@@ -0,0 +1,180 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+const SNAPSHOT_TIME_FORMAT = "20060102T150405.000000000Z"
+
+var snapshotIdPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{9}Z$`)
+
+/* A previous version of the whole configuration in the format of trainer.conf, the id is the time it was replaced */
+type Snapshot struct {
+	Id   string
+	Time time.Time
+	Size int64
+}
+
+func (store *ConfigurationStore) KeepSnapshots(count int) {
+	store.snapshots = count
+}
+
+/* snapshots/ next to trainer.conf, application files included */
+func (store *ConfigurationStore) snapshotDirectory() string {
+	return filepath.Join(filepath.Dir(store.trainerConfigurationFilePath), "snapshots")
+}
+
+func (store *ConfigurationStore) snapshotPrefix() string {
+	return filepath.Base(store.trainerConfigurationFilePath) + "."
+}
+
+func (store *ConfigurationStore) snapshot(content []byte) error {
+	if store.snapshots <= 0 {
+		return nil
+	}
+	directory := store.snapshotDirectory()
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format(SNAPSHOT_TIME_FORMAT)
+	if err := writeAndSync(filepath.Join(directory, store.snapshotPrefix() + id), content); err != nil {
+		return err
+	}
+	if err := syncDirectory(directory); err != nil {
+		return err
+	}
+
+	snapshots, err := store.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) <= store.snapshots {
+		return nil
+	}
+	for _, old := range snapshots[store.snapshots:] {
+		if err := os.Remove(filepath.Join(directory, store.snapshotPrefix() + old.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Newest first */
+func (store *ConfigurationStore) ListSnapshots() ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	files, err := ioutil.ReadDir(store.snapshotDirectory())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snapshots, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		id := strings.TrimPrefix(file.Name(), store.snapshotPrefix())
+		if file.IsDir() || id == file.Name() || !snapshotIdPattern.MatchString(id) {
+			continue
+		}
+		snapshotTime, err := time.Parse(SNAPSHOT_TIME_FORMAT, id)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Id: id, Time: snapshotTime, Size: file.Size()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Id > snapshots[j].Id })
+	return snapshots, nil
+}
+
+func (store *ConfigurationStore) ReadSnapshot(id string) (map[string]*model.ApplicationConfiguration, error) {
+	if !snapshotIdPattern.MatchString(id) {
+		return nil, errors.New("Could not find snapshot " + id)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(store.snapshotDirectory(), store.snapshotPrefix() + id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("Could not find snapshot " + id)
+		}
+		return nil, err
+	}
+	snapshot := ConfigurationStore{}
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, errors.New("Could not parse snapshot " + id + " - " + err.Error())
+	}
+	if snapshot.Configurations == nil {
+		snapshot.Configurations = make(map[string]*model.ApplicationConfiguration)
+	}
+	return snapshot.Configurations, nil
+}
+
+/* Replaces all applications with the ones from the snapshot, the current configuration becomes a snapshot itself
+   so a restore can be undone. Applications that are not in the snapshot are decommissioned like a DELETE through the
+   api, their instances would be left running otherwise. Snapshots that would not pass validation anymore are refused.
+   The caller holds the lock */
+func (store *ConfigurationStore) RestoreSnapshot(id string, actor string) (ValidationErrors, error) {
+	configurations, err := store.ReadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	if errs := ValidateConfigurations(configurations); len(errs) > 0 {
+		return errs, nil
+	}
+
+	decommissioned := []string{}
+	for _, name := range sortedNames(store.Configurations, nil) {
+		if _, ok := configurations[name]; ok {
+			continue
+		}
+		application := *store.Configurations[name]
+		if !application.Decommission {
+			application.Decommission = true
+			decommissioned = append(decommissioned, name)
+		}
+		configurations[name] = &application
+	}
+
+	previous := store.Configurations
+	store.Configurations = configurations
+	if err := store.Save(); err != nil {
+		store.Configurations = previous
+		return nil, err
+	}
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+		"message": "Restored configuration snapshot " + id + " with " + strconv.Itoa(len(configurations) - len(decommissioned)) + " applications",
+	}})
+	for _, name := range decommissioned {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+			"message": "Decommissioning application " + name + ", it is not in snapshot " + id,
+			"application": name,
+		}})
+	}
+	return nil, nil
+}
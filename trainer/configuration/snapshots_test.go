@@ -0,0 +1,219 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"gatoor/orca/trainer/model"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "orca-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testApplication(name string) *model.ApplicationConfiguration {
+	return &model.ApplicationConfiguration{
+		Name: name,
+		MinDeployment: 1,
+		DesiredDeployment: 1,
+		Config: map[string]model.VersionConfig{
+			"1": {Version: "1", DockerConfig: model.DockerConfig{Repository: "nginx"}},
+		},
+	}
+}
+
+/* Saves the store once per application, each save adds one more */
+func saveApplications(t *testing.T, store *ConfigurationStore, count int) {
+	for i := 1; i <= count; i++ {
+		name := "app" + strconv.Itoa(i)
+		store.Configurations[name] = testApplication(name)
+		if err := store.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	tests := []struct {
+		keep      int
+		snapshots int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{10, 4},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		store := &ConfigurationStore{}
+		store.Init(filepath.Join(dir, "trainer.conf"))
+		store.KeepSnapshots(test.keep)
+
+		/* the first save has nothing to replace */
+		saveApplications(t, store, 5)
+
+		snapshots, err := store.ListSnapshots()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != test.snapshots {
+			t.Errorf("keep %d: expected %d snapshots, got %d", test.keep, test.snapshots, len(snapshots))
+			continue
+		}
+		for i, snapshot := range snapshots {
+			if i > 0 && !snapshots[i - 1].Time.After(snapshot.Time) {
+				t.Errorf("keep %d: expected the newest snapshot first", test.keep)
+			}
+			configurations, err := store.ReadSnapshot(snapshot.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(configurations) != 4 - i {
+				t.Errorf("keep %d: expected snapshot %d to hold %d applications, got %d", test.keep, i, 4 - i, len(configurations))
+			}
+		}
+	}
+}
+
+func TestListSnapshotsIgnoresOtherFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := &ConfigurationStore{}
+	store.Init(filepath.Join(dir, "trainer.conf"))
+
+	if snapshots, err := store.ListSnapshots(); err != nil || len(snapshots) != 0 {
+		t.Fatalf("expected no snapshots without the directory, got %v %v", snapshots, err)
+	}
+
+	os.MkdirAll(store.snapshotDirectory(), 0755)
+	for _, name := range []string{"trainer.conf.20200101T000000.000000000Z", "trainer.conf.backup", "other.conf.20200101T000000.000000000Z", "README"} {
+		ioutil.WriteFile(filepath.Join(store.snapshotDirectory(), name), []byte("{}"), 0644)
+	}
+	os.Mkdir(filepath.Join(store.snapshotDirectory(), "trainer.conf.20200102T000000.000000000Z"), 0755)
+
+	snapshots, err := store.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Id != "20200101T000000.000000000Z" {
+		t.Errorf("expected only the snapshot of trainer.conf, got %v", snapshots)
+	}
+}
+
+func TestReadSnapshotInvalidId(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := &ConfigurationStore{}
+	store.Init(filepath.Join(dir, "sub", "trainer.conf"))
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("{}"), 0644)
+
+	for _, id := range []string{"", "latest", "../../secret", "20200101T000000Z", "20200101T000000.000000000Z"} {
+		if _, err := store.ReadSnapshot(id); err == nil || err.Error() != "Could not find snapshot " + id {
+			t.Errorf("%q: expected the snapshot not to be found, got %v", id, err)
+		}
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := &ConfigurationStore{}
+	store.Init(filepath.Join(dir, "trainer.conf"))
+	store.KeepSnapshots(10)
+	saveApplications(t, store, 3)
+
+	os.MkdirAll(store.snapshotDirectory(), 0755)
+	ioutil.WriteFile(filepath.Join(store.snapshotDirectory(), "trainer.conf.20000101T000000.000000000Z"),
+		[]byte(`{"Configurations": {"web": {"Name": "web", "MinDeployment": -1}}}`), 0644)
+
+	tests := []struct {
+		name           string
+		id             func(snapshots []Snapshot) string
+		validation     bool
+		fails          bool
+		/* Names of the applications that stay and the ones that are decommissioned */
+		active         []string
+		decommissioned []string
+	}{
+		{"unknown snapshot", func(snapshots []Snapshot) string { return "20010101T000000.000000000Z" }, false, true, []string{"app1", "app2", "app3"}, []string{}},
+		{"invalid snapshot", func(snapshots []Snapshot) string { return "20000101T000000.000000000Z" }, true, false, []string{"app1", "app2", "app3"}, []string{}},
+		{"oldest valid snapshot", func(snapshots []Snapshot) string { return snapshots[len(snapshots) - 2].Id }, false, false, []string{"app1"}, []string{"app2", "app3"}},
+		{"undo the restore", func(snapshots []Snapshot) string { return snapshots[0].Id }, false, false, []string{"app1", "app2", "app3"}, []string{}},
+	}
+	for _, test := range tests {
+		snapshots, _ := store.ListSnapshots()
+		errs, err := store.RestoreSnapshot(test.id(snapshots), "test")
+		if (err != nil) != test.fails || (len(errs) > 0) != test.validation {
+			t.Errorf("%s: unexpected result %v %v", test.name, errs, err)
+		}
+		active, decommissioned := []string{}, []string{}
+		for _, name := range sortedNames(store.Configurations, nil) {
+			if store.Configurations[name].Decommission {
+				decommissioned = append(decommissioned, name)
+			} else {
+				active = append(active, name)
+			}
+		}
+		if !reflect.DeepEqual(active, test.active) || !reflect.DeepEqual(decommissioned, test.decommissioned) {
+			t.Errorf("%s: expected %v and %v decommissioned, got %v and %v", test.name, test.active, test.decommissioned, active, decommissioned)
+		}
+	}
+
+	reloaded := &ConfigurationStore{}
+	reloaded.Init(filepath.Join(dir, "trainer.conf"))
+	reloaded.Load()
+	if len(reloaded.Configurations) != 3 {
+		t.Errorf("expected the restored configuration to be saved, got %d applications", len(reloaded.Configurations))
+	}
+}
+
+/* The file of an application that is not in the snapshot stays until the planner removed its instances */
+func TestRestoreSnapshotKeepsApplicationFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := applicationsStore(t, dir, "", map[string]string{"web.yaml": webYaml})
+	store.Load()
+	os.MkdirAll(store.snapshotDirectory(), 0755)
+	ioutil.WriteFile(filepath.Join(store.snapshotDirectory(), "trainer.conf.20000101T000000.000000000Z"),
+		[]byte(`{"Configurations": {"db": {"Name": "db", "MinDeployment": 1, "DesiredDeployment": 1, "Config": {}}}}`), 0644)
+
+	if errs, err := store.RestoreSnapshot("20000101T000000.000000000Z", "test"); err != nil || len(errs) > 0 {
+		t.Fatalf("unexpected result %v %v", errs, err)
+	}
+	if !store.Configurations["web"].Decommission || store.Configurations["db"] == nil {
+		t.Errorf("expected web to be decommissioned next to db, got %v", store.Configurations)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "applications", "web.yaml"))
+	if err != nil {
+		t.Fatalf("expected the file of web to be kept, got %v", err)
+	}
+	if string(content) != webYaml + "Decommission: true\n" {
+		t.Errorf("expected only the decommissioning to be written, got\n%s", content)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"gatoor/orca/trainer/model"
+)
+
+/* Field is the dotted path of the offending field, e.g. Config.3.PortMappings[0].HostPort */
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (err FieldError) Error() string {
+	return err.Field + ": " + err.Message
+}
+
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (errs *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (errs *ValidationErrors) addAll(prefix string, nested ValidationErrors) {
+	for _, err := range nested {
+		*errs = append(*errs, FieldError{Field: prefix + "." + err.Field, Message: err.Message})
+	}
+}
+
+/* All applications of a trainer.conf, including dependencies between them */
+func ValidateConfigurations(configurations map[string]*model.ApplicationConfiguration) ValidationErrors {
+	errs := ValidationErrors{}
+	names := []string{}
+	for name := range configurations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if configurations[name] == nil {
+			errs.add("Configurations." + name, "must not be null")
+			continue
+		}
+		errs.addAll("Configurations." + name, ValidateApplication(name, configurations[name]))
+	}
+	if len(errs) == 0 {
+		if err := ValidateDependencies(configurations); err != nil {
+			errs.add("Configurations", "%s", err)
+		}
+	}
+	return errs
+}
+
+/* The application on its own, dependencies on other applications are checked by ValidateDependencies */
+func ValidateApplication(name string, application *model.ApplicationConfiguration) ValidationErrors {
+	errs := ValidationErrors{}
+	if name == "" {
+		errs.add("Name", "must not be empty")
+	}
+	if application.Name != "" && application.Name != name {
+		errs.add("Name", "%s does not match %s", strconv.Quote(application.Name), strconv.Quote(name))
+	}
+	if application.MinDeployment < 0 {
+		errs.add("MinDeployment", "must not be negative")
+	}
+	if application.DesiredDeployment < 0 {
+		errs.add("DesiredDeployment", "must not be negative")
+	}
+	/* Zero follows MinDeployment */
+	if application.DesiredDeployment > 0 && application.DesiredDeployment < application.MinDeployment {
+		errs.add("DesiredDeployment", "must not be less than MinDeployment (%d)", application.MinDeployment)
+	}
+
+	versions := []string{}
+	for version := range application.Config {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	for _, version := range versions {
+		field := "Config." + version
+		if number, err := strconv.Atoi(version); err != nil || number <= 0 {
+			errs.add(field, "versions must be positive numbers")
+		}
+		config := application.Config[version]
+		if config.Version != "" && config.Version != version {
+			errs.add(field + ".Version", "%s does not match %s", strconv.Quote(config.Version), strconv.Quote(version))
+		}
+		errs.addAll(field, ValidateVersion(config))
+	}
+
+	if policy := application.Autoscaling; policy != nil {
+		if policy.Metric != model.AUTOSCALING_CPU && policy.Metric != model.AUTOSCALING_MEMORY {
+			errs.add("Autoscaling.Metric", "must be %s or %s", model.AUTOSCALING_CPU, model.AUTOSCALING_MEMORY)
+		}
+		if policy.TargetUtilization <= 0 || policy.TargetUtilization > 100 {
+			errs.add("Autoscaling.TargetUtilization", "must be greater than 0 and at most 100")
+		}
+		if policy.MaxDeployment <= 0 || policy.MaxDeployment < application.MinDeployment {
+			errs.add("Autoscaling.MaxDeployment", "must be greater than 0 and not less than MinDeployment (%d)", application.MinDeployment)
+		}
+		if policy.WindowSeconds < 0 || policy.ScaleUpCooldownSeconds < 0 || policy.ScaleDownCooldownSeconds < 0 {
+			errs.add("Autoscaling", "WindowSeconds and the cooldowns must not be negative")
+		}
+	}
+
+	for key := range application.Placement.Labels {
+		if key == "" {
+			errs.add("Placement.Labels", "label names must not be empty")
+		}
+	}
+	for i, other := range application.Placement.Affinity {
+		if other == name {
+			errs.add(fmt.Sprintf("Placement.Affinity[%d]", i), "instances of an application never share a host, it can't require itself")
+		}
+		for _, avoided := range application.Placement.AntiAffinity {
+			if other == avoided {
+				errs.add(fmt.Sprintf("Placement.Affinity[%d]", i), "%s is also in AntiAffinity", other)
+			}
+		}
+	}
+
+	for i, dependency := range application.Dependencies {
+		field := fmt.Sprintf("Dependencies[%d]", i)
+		if dependency.Application == "" {
+			errs.add(field + ".Application", "must not be empty")
+		} else if dependency.Application == name {
+			errs.add(field + ".Application", "an application can't depend on itself")
+		}
+		if dependency.Scope != "" && dependency.Scope != model.DEPENDENCY_CLUSTER && dependency.Scope != model.DEPENDENCY_HOST {
+			errs.add(field + ".Scope", "must be %s or %s", model.DEPENDENCY_CLUSTER, model.DEPENDENCY_HOST)
+		}
+	}
+	return errs
+}
+
+func ValidateVersion(config model.VersionConfig) ValidationErrors {
+	errs := ValidationErrors{}
+	if config.DockerConfig.Repository == "" {
+		errs.add("DockerConfig.Repository", "must not be empty")
+	}
+	if config.Needs.CpuNeeds < 0 || config.Needs.MemoryNeeds < 0 || config.Needs.NetworkNeeds < 0 {
+		errs.add("Needs", "must not be negative")
+	}
+
+	/* A host port can only be used once per host, a version mapping one twice could never be placed */
+	/* By number, "08080" is the same port as "8080" */
+	hostPorts := make(map[int]bool)
+	for i, mapping := range config.PortMappings {
+		field := fmt.Sprintf("PortMappings[%d]", i)
+		if !validPort(mapping.ContainerPort) {
+			errs.add(field + ".ContainerPort", "invalid port %s", strconv.Quote(mapping.ContainerPort))
+		}
+		if !validPort(mapping.HostPort) {
+			errs.add(field + ".HostPort", "invalid port %s", strconv.Quote(mapping.HostPort))
+			continue
+		}
+		hostPort, _ := strconv.Atoi(mapping.HostPort)
+		if hostPorts[hostPort] {
+			errs.add(field + ".HostPort", "host port %s is mapped more than once", mapping.HostPort)
+		}
+		hostPorts[hostPort] = true
+	}
+
+	for i, mapping := range config.VolumeMappings {
+		field := fmt.Sprintf("VolumeMappings[%d]", i)
+		if !path.IsAbs(mapping.HostPath) {
+			errs.add(field + ".HostPath", "must be an absolute path")
+		}
+		if !path.IsAbs(mapping.ContainerPath) {
+			errs.add(field + ".ContainerPath", "must be an absolute path")
+		}
+	}
+	for i, variable := range config.EnvironmentVariables {
+		if variable.Key == "" {
+			errs.add(fmt.Sprintf("EnvironmentVariables[%d].Key", i), "must not be empty")
+		}
+	}
+	for i, file := range config.Files {
+		if !path.IsAbs(file.HostPath) {
+			errs.add(fmt.Sprintf("Files[%d].HostPath", i), "must be an absolute path")
+		}
+	}
+
+	for i, check := range config.HealthChecks {
+		field := fmt.Sprintf("HealthChecks[%d]", i)
+		switch check.Type {
+		case model.HEALTH_CHECK_HTTP:
+			if !strings.HasPrefix(check.Path, "/") {
+				errs.add(field + ".Path", "must start with /")
+			}
+			if !validPort(check.Port) {
+				errs.add(field + ".Port", "invalid port %s", strconv.Quote(check.Port))
+			}
+		case model.HEALTH_CHECK_TCP:
+			if !validPort(check.Port) {
+				errs.add(field + ".Port", "invalid port %s", strconv.Quote(check.Port))
+			}
+		case model.HEALTH_CHECK_COMMAND:
+			if len(check.Command) == 0 {
+				errs.add(field + ".Command", "must not be empty")
+			}
+		default:
+			errs.add(field + ".Type", "must be %s, %s or %s", model.HEALTH_CHECK_HTTP, model.HEALTH_CHECK_TCP, model.HEALTH_CHECK_COMMAND)
+		}
+		if check.IntervalSeconds < 0 || check.TimeoutSeconds < 0 || check.StartPeriodSeconds < 0 || check.HealthyThreshold < 0 || check.UnhealthyThreshold < 0 {
+			errs.add(field, "intervals, timeouts and thresholds must not be negative")
+		} else if check.IntervalSeconds > 0 && check.TimeoutSeconds > check.IntervalSeconds {
+			errs.add(field + ".TimeoutSeconds", "must not be longer than IntervalSeconds")
+		}
+	}
+	return errs
+}
+
+func validPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number <= 65535
+}
+
+/* Dependencies have a known scope and don't form a cycle, an application in a cycle could never be deployed */
+func ValidateDependencies(configurations map[string]*model.ApplicationConfiguration) error {
+	names := []string{}
+	for name, application := range configurations {
+		names = append(names, name)
+		for _, dependency := range application.Dependencies {
+			if dependency.Scope != "" && dependency.Scope != model.DEPENDENCY_CLUSTER && dependency.Scope != model.DEPENDENCY_HOST {
+				return errors.New("Dependency of " + name + " on " + dependency.Application + " has the unknown scope " + strconv.Quote(dependency.Scope))
+			}
+			/* The planner would wait for it forever */
+			if _, ok := configurations[dependency.Application]; !ok {
+				return errors.New(name + " depends on the unknown application " + dependency.Application)
+			}
+		}
+	}
+	/* Sorted so the same cycle is always reported the same way */
+	sort.Strings(names)
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	marks := make(map[string]int)
+	var path []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, entry := range path {
+				if entry == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+		application, ok := configurations[name]
+		if !ok {
+			return nil
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dependency := range application.Dependencies {
+			if cycle := visit(dependency.Application); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path) - 1]
+		marks[name] = visited
+		return nil
+	}
+
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return errors.New("Dependency cycle " + strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
+
+/* Applications that depend on the named one, sorted. Decommissioned ones are left out, they are going away anyway */
+func Dependents(configurations map[string]*model.ApplicationConfiguration, name string) []string {
+	dependents := []string{}
+	for other, application := range configurations {
+		if application.Decommission {
+			continue
+		}
+		for _, dependency := range application.Dependencies {
+			if dependency.Application == name {
+				dependents = append(dependents, other)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
@@ -0,0 +1,162 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"gatoor/orca/trainer/model"
+)
+
+/* name -> dependencies, "app:host" for the host scope */
+func dependencyGraph(graph map[string][]string) map[string]*model.ApplicationConfiguration {
+	configurations := make(map[string]*model.ApplicationConfiguration)
+	for name, dependencies := range graph {
+		application := &model.ApplicationConfiguration{Name: name, Config: map[string]model.VersionConfig{}}
+		for _, dependency := range dependencies {
+			scope := ""
+			if len(dependency) > 5 && dependency[len(dependency) - 5:] == ":host" {
+				dependency, scope = dependency[:len(dependency) - 5], model.DEPENDENCY_HOST
+			}
+			application.Dependencies = append(application.Dependencies, model.Dependency{Application: dependency, Scope: scope})
+		}
+		configurations[name] = application
+	}
+	return configurations
+}
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph map[string][]string
+		err   string
+	}{
+		{"no dependencies", map[string][]string{"web": nil, "db": nil}, ""},
+		{"chain", map[string][]string{"web": {"api"}, "api": {"db:host"}, "db": nil}, ""},
+		{"shared dependency", map[string][]string{"web": {"db"}, "api": {"db"}, "db": nil}, ""},
+		{"two applications", map[string][]string{"a": {"b"}, "b": {"a"}}, "Dependency cycle a -> b -> a"},
+		{"three applications", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, "Dependency cycle a -> b -> c -> a"},
+		{"cycle behind a chain", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}}, "Dependency cycle b -> c -> b"},
+		{"unknown application", map[string][]string{"web": {"db"}}, "web depends on the unknown application db"},
+	}
+	for _, test := range tests {
+		err := ValidateDependencies(dependencyGraph(test.graph))
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != test.err {
+			t.Errorf("%s: expected %q, got %q", test.name, test.err, message)
+		}
+	}
+}
+
+func TestValidateDependenciesUnknownScope(t *testing.T) {
+	configurations := dependencyGraph(map[string][]string{"web": {"db"}, "db": nil})
+	configurations["web"].Dependencies[0].Scope = "zone"
+	if err := ValidateDependencies(configurations); err == nil {
+		t.Error("expected the unknown scope to be refused")
+	}
+}
+
+func TestDependents(t *testing.T) {
+	configurations := dependencyGraph(map[string][]string{"web": {"db"}, "api": {"db"}, "worker": {"api"}, "db": nil})
+	tests := []struct {
+		application  string
+		decommission string
+		dependents   []string
+	}{
+		{"db", "", []string{"api", "web"}},
+		{"api", "", []string{"worker"}},
+		{"web", "", []string{}},
+		{"db", "web", []string{"api"}},
+	}
+	for _, test := range tests {
+		for name, application := range configurations {
+			application.Decommission = name == test.decommission
+		}
+		if dependents := Dependents(configurations, test.application); !reflect.DeepEqual(dependents, test.dependents) {
+			t.Errorf("%s: expected %v, got %v", test.application, test.dependents, dependents)
+		}
+	}
+}
+
+/* The ports as "host:container" */
+func withPorts(config model.VersionConfig, ports ...string) model.VersionConfig {
+	for _, port := range ports {
+		parts := strings.Split(port, ":")
+		config.PortMappings = append(config.PortMappings, model.PortMapping{HostPort: parts[0], ContainerPort: parts[1]})
+	}
+	return config
+}
+
+func TestValidateApplication(t *testing.T) {
+	valid := func() *model.ApplicationConfiguration {
+		return &model.ApplicationConfiguration{
+			Name: "web",
+			MinDeployment: 1,
+			DesiredDeployment: 2,
+			Config: map[string]model.VersionConfig{
+				"1": {Version: "1", DockerConfig: model.DockerConfig{Repository: "nginx"}},
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(application *model.ApplicationConfiguration)
+		fields []string
+	}{
+		{"valid", func(application *model.ApplicationConfiguration) {}, nil},
+		{"negative minimum", func(application *model.ApplicationConfiguration) { application.MinDeployment = -1 }, []string{"MinDeployment"}},
+		{"desired below minimum", func(application *model.ApplicationConfiguration) { application.MinDeployment = 3 }, []string{"DesiredDeployment"}},
+		{"depends on itself", func(application *model.ApplicationConfiguration) {
+			application.Dependencies = []model.Dependency{{Application: "web"}}
+		}, []string{"Dependencies[0].Application"}},
+		{"empty dependency", func(application *model.ApplicationConfiguration) {
+			application.Dependencies = []model.Dependency{{}}
+		}, []string{"Dependencies[0].Application"}},
+		{"unknown scope", func(application *model.ApplicationConfiguration) {
+			application.Dependencies = []model.Dependency{{Application: "db", Scope: "zone"}}
+		}, []string{"Dependencies[0].Scope"}},
+		{"missing repository", func(application *model.ApplicationConfiguration) {
+			application.Config["1"] = model.VersionConfig{Version: "1"}
+		}, []string{"Config.1.DockerConfig.Repository"}},
+		{"invalid port", func(application *model.ApplicationConfiguration) {
+			application.Config["1"] = withPorts(application.Config["1"], "8080:80", "http:80")
+		}, []string{"Config.1.PortMappings[1].HostPort"}},
+		{"host port mapped twice", func(application *model.ApplicationConfiguration) {
+			application.Config["1"] = withPorts(application.Config["1"], "8080:80", "8081:80", "8080:443")
+		}, []string{"Config.1.PortMappings[2].HostPort"}},
+		{"host port mapped twice with a leading zero", func(application *model.ApplicationConfiguration) {
+			application.Config["1"] = withPorts(application.Config["1"], "8080:80", "08080:443")
+		}, []string{"Config.1.PortMappings[1].HostPort"}},
+	}
+	for _, test := range tests {
+		application := valid()
+		test.change(application)
+		fields := []string{}
+		for _, err := range ValidateApplication("web", application) {
+			fields = append(fields, err.Field)
+		}
+		if len(fields) != len(test.fields) || (len(fields) > 0 && !reflect.DeepEqual(fields, test.fields)) {
+			t.Errorf("%s: expected errors in %v, got %v", test.name, test.fields, fields)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_HOST_DISCOVERED   = "host_discovered"
+	EVENT_HOST_LOST         = "host_lost"
+	EVENT_APPLICATION_STATE = "application_state"
+	EVENT_PLANNING          = "planning"
+	EVENT_CHANGE            = "change"
+	EVENT_AUDIT             = "audit"
+)
+
+const (
+	CHANGE_CREATED   = "created"
+	CHANGE_DRAINING  = "draining"
+	CHANGE_APPLIED   = "applied"
+	CHANGE_COMPLETED = "completed"
+	CHANGE_FAILED    = "failed"
+	CHANGE_TIMED_OUT = "timed_out"
+)
+
+/* Subscribers that can't keep up lose events instead of blocking the trainer */
+const SUBSCRIBER_BUFFER = 100
+
+type Event struct {
+	Type        string
+	Time        string
+	HostId      string
+	Application string
+	Details     map[string]string
+}
+
+type Bus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+	/* Applied to the details before the event is published, keeps secret values out of the event stream */
+	redact      func(string) string
+}
+
+/* Everything that happens in the cluster is published here */
+var Cluster Bus
+
+func (bus *Bus) SetRedactor(redact func(string) string) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.redact = redact
+}
+
+func (bus *Bus) Publish(event Event) {
+	event.Time = time.Now().Format(time.RFC3339Nano)
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.redact != nil {
+		redacted := make(map[string]string)
+		for key, value := range event.Details {
+			redacted[key] = bus.redact(value)
+		}
+		event.Details = redacted
+	}
+
+	for subscriber := range bus.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func (bus *Bus) Subscribe() chan Event {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[chan Event]bool)
+	}
+	subscriber := make(chan Event, SUBSCRIBER_BUFFER)
+	bus.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (bus *Bus) Unsubscribe(subscriber chan Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	delete(bus.subscribers, subscriber)
+}
+
+func PublishChange(hostId string, application string, changeId string, changeType string, status string) {
+	Cluster.Publish(Event{
+		Type: EVENT_CHANGE,
+		HostId: hostId,
+		Application: application,
+		Details: map[string]string{"change": changeId, "type": changeType, "status": status},
+	})
+}
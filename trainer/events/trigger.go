@@ -0,0 +1,72 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Collects Fire calls for the debounce period and then signals C once, so a burst of
+   checkins or config posts results in a single planning run */
+type Trigger struct {
+	C chan string
+
+	debounce time.Duration
+	lock     sync.Mutex
+	timer    *time.Timer
+	reasons  []string
+}
+
+var PlanningTrigger Trigger
+
+func (trigger *Trigger) Init(debounce time.Duration) {
+	trigger.C = make(chan string, 1)
+	trigger.debounce = debounce
+}
+
+func (trigger *Trigger) Fire(reason string) {
+	/* Not initialized, nobody is listening */
+	if trigger.C == nil {
+		return
+	}
+
+	trigger.lock.Lock()
+	defer trigger.lock.Unlock()
+
+	trigger.reasons = append(trigger.reasons, reason)
+	if trigger.timer == nil {
+		trigger.timer = time.AfterFunc(trigger.debounce, trigger.flush)
+	}
+}
+
+func (trigger *Trigger) flush() {
+	trigger.lock.Lock()
+	reasons := strings.Join(trigger.reasons, ", ")
+	trigger.reasons = nil
+	trigger.timer = nil
+	trigger.lock.Unlock()
+
+	select {
+	case trigger.C <- reasons:
+	default:
+		/* A run is already queued, it will pick up whatever caused this one */
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package loadbalancer
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/state"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+var LoadBalancerLogger = Logger.LoggerWithField(Logger.Logger, "module", "loadbalancer")
+
+type Backend struct {
+	HostId  string
+	Version string
+	Address string
+	Port    string
+}
+
+/* The instances of one application behind one of its container ports */
+type Pool struct {
+	Name          string
+	Application   string
+	ContainerPort string
+	Backends      []Backend
+}
+
+/* Named by VersionConfig.LoadBalancer */
+type LoadBalancer struct {
+	Name  string
+	Pools []Pool
+}
+
+/* Where the pools end up, e.g. a config file of a load balancer on the trainer machine */
+type Output interface {
+	Write(balancers []LoadBalancer) error
+}
+
+/* Keeps the backend pools of the load balancers in sync with the running instances */
+type Generator struct {
+	lock      sync.Mutex
+	outputs   []Output
+	balancers []LoadBalancer
+}
+
+func (generator *Generator) Init(outputs []Output) {
+	generator.outputs = outputs
+	generator.balancers = []LoadBalancer{}
+}
+
+/* Regenerates whenever instances change state, start draining or hosts come and go, runs until the trainer stops */
+func (generator *Generator) Watch(configurationStore *configuration.ConfigurationStore, currentState *state.StateStore) {
+	generator.Regenerate(configurationStore, currentState)
+	go func() {
+		for event := range events.Cluster.Subscribe() {
+			switch event.Type {
+			case events.EVENT_APPLICATION_STATE, events.EVENT_HOST_LOST, events.EVENT_HOST_DISCOVERED, events.EVENT_CHANGE:
+				generator.Regenerate(configurationStore, currentState)
+			}
+		}
+	}()
+}
+
+func (generator *Generator) Regenerate(configurationStore *configuration.ConfigurationStore, currentState *state.StateStore) {
+	configurationStore.ReadLock()
+	balancers := Build(configurationStore, currentState)
+	configurationStore.ReadUnlock()
+
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+
+	if reflect.DeepEqual(balancers, generator.balancers) {
+		return
+	}
+	generator.balancers = balancers
+
+	for _, output := range generator.outputs {
+		if err := output.Write(balancers); err != nil {
+			LoadBalancerLogger.Errorf("Could not write load balancer configuration - %s", err)
+		}
+	}
+	LoadBalancerLogger.Infof("Regenerated %d load balancers", len(balancers))
+}
+
+func (generator *Generator) Current() []LoadBalancer {
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+	return generator.balancers
+}
+
+/* Healthy instances of every version that names a load balancer, on hosts that are up, unless they are draining. Pools of applications without
+   instances are kept so the load balancer configuration doesn't lose the backend */
+func Build(configurationStore *configuration.ConfigurationStore, currentState *state.StateStore) []LoadBalancer {
+	pools := make(map[string]map[string]*Pool)
+	addPool := func(balancer string, application string, containerPort string) *Pool {
+		if _, ok := pools[balancer]; !ok {
+			pools[balancer] = make(map[string]*Pool)
+		}
+		name := application + "_" + containerPort
+		if _, ok := pools[balancer][name]; !ok {
+			pools[balancer][name] = &Pool{Name: name, Application: application, ContainerPort: containerPort, Backends: []Backend{}}
+		}
+		return pools[balancer][name]
+	}
+
+	for name, application := range configurationStore.GetAllConfiguration() {
+		config := application.Config[application.GetLatestVersion()]
+		if config.LoadBalancer == "" {
+			continue
+		}
+		for _, mapping := range config.PortMappings {
+			addPool(config.LoadBalancer, name, mapping.ContainerPort)
+		}
+	}
+
+	for _, host := range currentState.GetAllHosts() {
+		if host.State != state.HOST_RUNNING || host.Ip == "" {
+			continue
+		}
+		for _, running := range host.Apps {
+			application, err := configurationStore.GetConfiguration(running.Name)
+			if err != nil {
+				continue
+			}
+			config, ok := application.Config[running.Version]
+			if !ok || config.LoadBalancer == "" || !running.IsHealthy(config) || host.IsDraining(running.Name) {
+				continue
+			}
+			for _, mapping := range config.PortMappings {
+				pool := addPool(config.LoadBalancer, running.Name, mapping.ContainerPort)
+				pool.Backends = append(pool.Backends, Backend{HostId: host.Id, Version: running.Version, Address: host.Ip, Port: mapping.HostPort})
+			}
+		}
+	}
+
+	return sortedBalancers(pools)
+}
+
+/* Hosts and applications live in maps, sorting keeps the output stable so unchanged pools don't cause rewrites */
+func sortedBalancers(pools map[string]map[string]*Pool) []LoadBalancer {
+	balancers := []LoadBalancer{}
+	for name, byPool := range pools {
+		balancer := LoadBalancer{Name: name, Pools: []Pool{}}
+		for _, pool := range byPool {
+			sort.Slice(pool.Backends, func(i, j int) bool {
+				if pool.Backends[i].HostId != pool.Backends[j].HostId {
+					return pool.Backends[i].HostId < pool.Backends[j].HostId
+				}
+				return pool.Backends[i].Port < pool.Backends[j].Port
+			})
+			balancer.Pools = append(balancer.Pools, *pool)
+		}
+		sort.Slice(balancer.Pools, func(i, j int) bool { return balancer.Pools[i].Name < balancer.Pools[j].Name })
+		balancers = append(balancers, balancer)
+	}
+	sort.Slice(balancers, func(i, j int) bool { return balancers[i].Name < balancers[j].Name })
+	return balancers
+}
@@ -0,0 +1,135 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+const (
+	FORMAT_HAPROXY = "haproxy"
+	FORMAT_NGINX   = "nginx"
+)
+
+var KnownFormats = []string{FORMAT_HAPROXY, FORMAT_NGINX}
+
+/* Only the backends are generated, the file is meant to be included next to the hand written frontends */
+type FileOutput struct {
+	Format        string
+	/* Empty writes all load balancers */
+	Balancer      string
+	File          string
+	/* Run after the file changed, e.g. "systemctl reload haproxy" */
+	ReloadCommand string
+}
+
+func NewFileOutput(format string, balancer string, file string, reloadCommand string) (*FileOutput, error) {
+	if format != FORMAT_HAPROXY && format != FORMAT_NGINX {
+		return nil, errors.New("Unknown load balancer format " + format)
+	}
+	if file == "" {
+		return nil, errors.New("No file for the " + format + " load balancer output")
+	}
+	return &FileOutput{Format: format, Balancer: balancer, File: file, ReloadCommand: reloadCommand}, nil
+}
+
+func (output *FileOutput) Write(balancers []LoadBalancer) error {
+	selected := []LoadBalancer{}
+	for _, balancer := range balancers {
+		if output.Balancer == "" || balancer.Name == output.Balancer {
+			selected = append(selected, balancer)
+		}
+	}
+
+	var content []byte
+	if output.Format == FORMAT_HAPROXY {
+		content = renderHaproxy(selected)
+	} else {
+		content = renderNginx(selected)
+	}
+
+	if existing, err := ioutil.ReadFile(output.File); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+
+	/* The load balancer may read the file any time, it must never see half of it */
+	tmpFile := output.File + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, output.File); err != nil {
+		return err
+	}
+
+	if output.ReloadCommand != "" {
+		if out, err := exec.Command("sh", "-c", output.ReloadCommand).CombinedOutput(); err != nil {
+			return fmt.Errorf("Reloading with %s failed - %s: %s", output.ReloadCommand, err, out)
+		}
+	}
+	return nil
+}
+
+func renderHaproxy(balancers []LoadBalancer) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("# Generated by the orca trainer, changes will be overwritten\n")
+	for _, balancer := range balancers {
+		for _, pool := range balancer.Pools {
+			fmt.Fprintf(&buffer, "\n# %s: %s port %s\nbackend %s\n    balance roundrobin\n", balancer.Name, pool.Application, pool.ContainerPort, identifier(balancer, pool))
+			for _, backend := range pool.Backends {
+				fmt.Fprintf(&buffer, "    server %s %s:%s check\n", sanitize(backend.HostId + "_" + backend.Port), backend.Address, backend.Port)
+			}
+		}
+	}
+	return buffer.Bytes()
+}
+
+func renderNginx(balancers []LoadBalancer) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("# Generated by the orca trainer, changes will be overwritten\n")
+	for _, balancer := range balancers {
+		for _, pool := range balancer.Pools {
+			fmt.Fprintf(&buffer, "\n# %s: %s port %s\nupstream %s {\n", balancer.Name, pool.Application, pool.ContainerPort, identifier(balancer, pool))
+			for _, backend := range pool.Backends {
+				fmt.Fprintf(&buffer, "    server %s:%s;\n", backend.Address, backend.Port)
+			}
+			/* nginx refuses an upstream without servers */
+			if len(pool.Backends) == 0 {
+				buffer.WriteString("    server 127.0.0.1:1 down;\n")
+			}
+			buffer.WriteString("}\n")
+		}
+	}
+	return buffer.Bytes()
+}
+
+var invalidIdentifierCharacters = regexp.MustCompile("[^A-Za-z0-9_.-]")
+
+func sanitize(name string) string {
+	return invalidIdentifierCharacters.ReplaceAllString(name, "_")
+}
+
+func identifier(balancer LoadBalancer, pool Pool) string {
+	return sanitize(balancer.Name + "_" + pool.Name)
+}
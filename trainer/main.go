@@ -29,134 +29,347 @@ import (
 	"gatoor/orca/trainer/cloud"
 	"flag"
 	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/events"
+	"gatoor/orca/trainer/auth"
+	"gatoor/orca/trainer/metrics"
+	"gatoor/orca/trainer/loadbalancer"
+	"gatoor/orca/trainer/secrets"
+	Logger "gatoor/orca/trainer/logs"
 )
 
-const MAX_ELAPSED_TIME_FOR_APP_CHANGE = 120
-
 func main() {
 	fmt.Println("starting")
 	var configurationRoot = flag.String("configroot", "/orca/config", "Configuration Root Directory")
-	var apiPort = flag.Int("port", 5001, "API Port")
-
-	//AWS Properties
-	var cloudProvider = flag.String("cloudprovider", "aws", "Cloud Provider")
-	var awsAccessKeyId = flag.String("awsaccesskeyid", "", "Amazon AWS Access Key")
-	var awsAccessKeySecret = flag.String("awsaccesskeysecret", "", "Amazon AWS Access Key Secret")
-	var awsRegion = flag.String("awsregion", "", "Amazon Region")
-	var awsBaseAmi = flag.String("awsbaseami", "", "Amazon Base AMI")
-	var awsSshKey = flag.String("awssshkey", "", "Amazon SSH Key")
-	var awsSshKeyPath = flag.String("awssshkeypath", "", "Amazon SSH Key Absolute Path")
-	var awsSecurityGroupId = flag.String("awssgroup", "", "Amazon Security Group")
-	var plannerAlg = flag.String("planner", "boringplanner", "Planning Algorithm")
-	var instanceUsername = flag.String("instanceusername", "ubuntu", "User account for the AMI")
-	var uri = flag.String("uri", "http://localhost:5001", "Public Trainer Endpoint")
+	var settingsFile = flag.String("settings", "", "Trainer settings file, defaults to settings.conf in the configuration root")
 
 	flag.Parse()
 
+	if (*settingsFile) == "" {
+		(*settingsFile) = (*configurationRoot) + "/settings.conf"
+	}
+
+	settings, err := configuration.LoadTrainerSettings(*settingsFile)
+	if err != nil {
+		Logger.InitLogger.Fatalf("Invalid trainer settings:\n%s", err)
+	}
+	maxElapsedTimeForAppChange := int64(settings.MaxElapsedTimeForAppChangeSeconds)
+
 	store := &configuration.ConfigurationStore{};
 	store.Init(*configurationRoot + "/trainer.conf")
+	store.KeepSnapshots(settings.ConfigurationSnapshots)
+	applicationsDirectory := settings.ApplicationsDirectory
+	if applicationsDirectory == "" {
+		applicationsDirectory = (*configurationRoot) + "/applications"
+	}
+	store.UseApplicationsDirectory(applicationsDirectory)
 
 	state_store := &state.StateStore{};
 	state_store.Init()
+	state_store.History.Init(settings.MetricsHistory.RawSamples, time.Second * time.Duration(settings.MetricsHistory.BucketSeconds), settings.MetricsHistory.Buckets, settings.MetricsHistory.PersistFile)
+	/* Once per bucket, series of hosts and applications that are gone would stay in memory otherwise */
+	state_store.History.PruneEvery(time.Second * time.Duration(settings.MetricsHistory.BucketSeconds))
+	if settings.MetricsHistory.PersistFile != "" {
+		state_store.History.PersistEvery(time.Second * time.Duration(settings.MetricsHistory.PersistIntervalSeconds))
+	}
 
 	store.Load()
+	state_store.LoadHostLabels((*configurationRoot) + "/hostlabels.json")
+
+	/* Init connection to the database for auditing, the uri used to live in trainer.conf */
+	if settings.Audit.Backend == "mongo" {
+		auditDatabaseUri := settings.Audit.DatabaseUri
+		if auditDatabaseUri == "" {
+			auditDatabaseUri = store.AuditDatabaseUri
+		}
+		state.Audit.Init(auditDatabaseUri)
+	}
 
-	/* Init connection to the database for auditing */
-	state.Audit.Init(store.AuditDatabaseUri)
+	secretsFile, masterKeyFile := settings.Secrets.File, settings.Secrets.MasterKeyFile
+	if secretsFile == "" {
+		secretsFile = (*configurationRoot) + "/secrets.json"
+	}
+	if masterKeyFile == "" {
+		masterKeyFile = (*configurationRoot) + "/secrets.key"
+	}
+	masterKey, err := secrets.LoadMasterKey(masterKeyFile, settings.Secrets.MasterKey, secretsFile)
+	if err != nil {
+		Logger.InitLogger.Fatalf("Could not load the secrets master key - %s", err)
+	}
+	secretStore := &secrets.SecretStore{}
+	if err := secretStore.Init(secretsFile, masterKey); err != nil {
+		Logger.InitLogger.Fatalf("Could not load the secrets - %s", err)
+	}
+	state.Audit.SetRedactor(secretStore.Redact)
+	events.Cluster.SetRedactor(secretStore.Redact)
 
 	var plannerEngine planner.Planner;
-	if (*plannerAlg) == "boringplanner"{
+	if settings.Planner.Name == "boringplanner" {
 		//WARNING: This planner is verrrry dumb, it will cost you moneyzzzzz
 		//Mostly implemented to prove the system actually works, and the interface has been
 		//defined well enough to support a more complicated planner
 		plannerEngine = &planner.BoringPlanner{}
 
-	}else if (*plannerAlg) == "diffplan" {
+	}else if settings.Planner.Name == "diffplan" {
 		//TODO: @Alex implement this guy
 		plannerEngine = &planner.DiffPlan{}
 	}
+	plannerEngine.Init(settings.Planner.Parameters)
 
 	cloud_provider := cloud.CloudProvider{}
 
-	if (*cloudProvider) == "aws" {
+	providerSettings := settings.ActiveCloudProvider()
+	if providerSettings.Type == "aws" {
+		awsSettings := providerSettings.Aws
 		awsEngine := cloud.AwsCloudEngine{}
-		awsEngine.Init((*awsAccessKeyId), (*awsAccessKeySecret), (*awsRegion), (*awsBaseAmi), (*awsSshKey), (*awsSshKeyPath), (*awsSecurityGroupId))
-		cloud_provider.Init(&awsEngine, (*instanceUsername), (*uri))
+		awsEngine.Init(awsSettings.AccessKeyId, awsSettings.AccessKeySecret, awsSettings.Region, awsSettings.BaseAmi, awsSettings.SshKey, awsSettings.SshKeyPath, awsSettings.SecurityGroupId)
+		awsEngine.ConfigureInstances(awsSettings.Subnets, awsSettings.UsePrivateIp, awsSettings.InstanceProfile, awsSettings.RootVolumeSize)
+		cloud_provider.Init(&awsEngine, providerSettings.InstanceUsername, settings.Api.PublicUri)
+	}
+
+	authenticator := &auth.Authenticator{}
+	hostTokensFile := settings.Auth.HostTokensFile
+	if hostTokensFile == "" {
+		hostTokensFile = (*configurationRoot) + "/hosttokens.json"
+	}
+	authenticator.Init(settings.Auth.Enabled, settings.Auth.Operators, hostTokensFile)
+	if settings.Auth.Enabled {
+		cloud_provider.SetCredentialIssuer(authenticator)
+	}
+
+	api := api.Api{}
+	if settings.Api.Tls.CertFile != "" {
+		var certificateAuthority *auth.CertificateAuthority
+		if settings.Api.Tls.MutualTls {
+			caCertFile, caKeyFile := settings.Api.Tls.CaCertFile, settings.Api.Tls.CaKeyFile
+			if caCertFile == "" {
+				caCertFile = (*configurationRoot) + "/ca.crt"
+			}
+			if caKeyFile == "" {
+				caKeyFile = (*configurationRoot) + "/ca.key"
+			}
+			certificateAuthority = &auth.CertificateAuthority{}
+			if err := certificateAuthority.Init(caCertFile, caKeyFile, (*configurationRoot) + "/hostcertificates.json"); err != nil {
+				Logger.InitLogger.Fatalf("Could not initialize the certificate authority - %s", err)
+			}
+			cloud_provider.SetCertificateIssuer(certificateAuthority)
+		}
+		api.ConfigureTls(settings.Api.Tls.CertFile, settings.Api.Tls.KeyFile, certificateAuthority)
+	}
+
+	loadBalancerOutputs := []loadbalancer.Output{}
+	for _, output := range settings.LoadBalancerOutputs {
+		fileOutput, err := loadbalancer.NewFileOutput(output.Format, output.LoadBalancer, output.File, output.ReloadCommand)
+		if err != nil {
+			Logger.InitLogger.Fatalf("Invalid load balancer output - %s", err)
+		}
+		loadBalancerOutputs = append(loadBalancerOutputs, fileOutput)
 	}
+	loadBalancers := &loadbalancer.Generator{}
+	loadBalancers.Init(loadBalancerOutputs)
+	loadBalancers.Watch(store, state_store)
+	api.ConfigureLoadBalancers(loadBalancers)
+	api.ConfigureSecrets(secretStore)
+	api.ConfigureCloudProvider(&cloud_provider)
+
+	store.Watch(time.Second * time.Duration(settings.ConfigurationReloadSeconds))
+
+	ticker := time.NewTicker(time.Second * time.Duration(settings.PlanningIntervalSeconds))
+
+	metrics.Trainer.Describe("orca_planning_duration_seconds", metrics.TYPE_SUMMARY, "Time spent in the planner")
+	metrics.Trainer.Describe("orca_pending_changes", metrics.TYPE_GAUGE, "Changes waiting to be resolved")
+	metrics.Trainer.Describe("orca_changes_dispatched_total", metrics.TYPE_COUNTER, "Changes dispatched to hosts and the cloud provider")
+	metrics.Trainer.Describe("orca_spawn_failures_total", metrics.TYPE_COUNTER, "New servers the cloud provider failed to create")
+	metrics.Trainer.Add("orca_spawn_failures_total", nil, 0)
 
-	ticker := time.NewTicker(time.Second * 10)
+	/* Turns the changes from the planner into server and application changes */
+	dispatch := func(changes []planner.PlanningChange) {
+		store.WriteLock()
+		defer store.WriteUnlock()
+
+		for _, change := range changes {
+			metrics.Trainer.Add("orca_changes_dispatched_total", metrics.Labels{"type": change.Type}, 1)
+			if change.Type == "new_server" {
+				/* Add new server */
+				cloud_provider.ActionChange(&model.ChangeServer{
+					Id:uuid.NewV4().String(),
+					Type: "new_server",
+					Time:time.Now().Format(time.RFC3339Nano),
+					RequiresReliableInstance: change.RequiresReliableInstance,
+				})
+
+				continue
+			}
+			if change.Type == "add_application" || change.Type == "remove_application" {
+				/* Add new server */
+				host, err := state_store.GetConfiguration(change.HostId)
+				if err != nil {
+					fmt.Println("Dropping change for unknown host " + change.HostId)
+					continue
+				}
+				app, err := store.GetConfiguration(change.ApplicationName)
+				if err != nil {
+					fmt.Println("Dropping change for unknown application " + change.ApplicationName)
+					continue
+				}
+				if app.Decommission {
+					state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+						"message": "Removing decommissioned application " + app.Name + " from host " + host.Id,
+						"application": app.Name,
+						"host": host.Id,
+					}})
+				}
+				applicationChange := model.ChangeApplication{
+					Id: uuid.NewV4().String(),
+					Type: change.Type,
+					HostId: host.Id,
+					AppConfig: app.GetLatestConfiguration(),
+					Name: change.ApplicationName,
+					Time:time.Now().Format(time.RFC3339Nano),
+				}
+				if change.Type == "remove_application" && settings.ConnectionDrainSeconds > 0 && isBehindLoadBalancer(host, app) {
+					state_store.DrainAndRemove(host.Id, applicationChange, time.Second * time.Duration(settings.ConnectionDrainSeconds))
+				} else {
+					state_store.AddChange(host.Id, applicationChange)
+				}
+
+				continue
+			}
+			if change.Type == "delete_application" {
+				/* Decommissioning is done, no instances are left */
+				if err := store.Remove(change.ApplicationName, state.ACTOR_TRAINER); err == nil {
+					if err := store.Save(); err != nil {
+						Logger.Logger.Errorf("Could not save the configuration - %s", err)
+					}
+				}
+				continue
+			}
+			if change.Type == "kill_server" {
+				/* The host is forgotten once it stops checking in */
+				if err := state_store.MarkTerminating(change.HostId); err != nil {
+					fmt.Println("Dropping kill_server for unknown host " + change.HostId)
+					continue
+				}
+				state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+					"message": "Terminating host " + change.HostId,
+					"host": change.HostId,
+				}})
+				cloud_provider.ActionChange(&model.ChangeServer{
+					Id:uuid.NewV4().String(),
+					Type: "remove",
+					Time:time.Now().Format(time.RFC3339Nano),
+					HostId: change.HostId,
+				})
+				continue
+			}
+		}
+	}
+
+	/* Failed terminations hand the host back to the planner, new hosts get the labels the cloud provider knows */
+	go func() {
+		for event := range events.Cluster.Subscribe() {
+			if event.Type == events.EVENT_CHANGE && event.Details["type"] == "remove" && event.Details["status"] == events.CHANGE_FAILED {
+				state_store.CancelTermination(event.HostId)
+			}
+			if event.Type == events.EVENT_HOST_DISCOVERED && event.Details["recovered"] == "" {
+				go func(hostId string) {
+					state_store.SetCloudLabels(hostId, cloud_provider.Engine.GetLabels(cloud.HostId(hostId)))
+				}(event.HostId)
+			}
+		}
+	}()
+
+	autoscaler := &planner.Autoscaler{}
+	autoscaler.Init()
+
+	controller := &planner.Controller{}
+	controller.Init(settings.Planner.Mode, dispatch)
+
+	/* Besides the ticker, planning runs shortly after anything that could change the plan happened */
+	events.PlanningTrigger.Init(time.Millisecond * time.Duration(settings.PlanningDebounceMilliseconds))
 
 	go func () {
 		for {
-			<- ticker.C
-			fmt.Println("Running Planning task")
+			select {
+			case <- ticker.C:
+				fmt.Println("Running Planning task")
+			case reason := <- events.PlanningTrigger.C:
+				fmt.Println("Running Planning task, triggered by " + reason)
+			}
+
+			state_store.CheckLostHosts(time.Second * time.Duration(settings.HostLostAfterSeconds))
 
 			/* Check for timeouts */
 			for _, host := range state_store.GetAllHosts() {
 				for _, change := range host.Changes {
 					parsedTime, _ := time.Parse(time.RFC3339Nano, change.Time)
-					if (time.Now().Unix() - parsedTime.Unix()) > MAX_ELAPSED_TIME_FOR_APP_CHANGE {
+					if (time.Now().Unix() - parsedTime.Unix()) > maxElapsedTimeForAppChange {
 						state_store.RemoveChange(host.Id, change.Id)
+						events.PublishChange(host.Id, change.Name, change.Id, change.Type, events.CHANGE_TIMED_OUT)
 					}
 				}
 			}
 
 			for _, change := range cloud_provider.GetAllChanges() {
 					parsedTime, _ := time.Parse(time.RFC3339Nano, change.Time)
-					if (time.Now().Unix() - parsedTime.Unix()) > MAX_ELAPSED_TIME_FOR_APP_CHANGE {
+					if (time.Now().Unix() - parsedTime.Unix()) > maxElapsedTimeForAppChange {
 						cloud_provider.RemoveChange(change.Id)
+						events.PublishChange(change.NewHostId, "", change.Id, change.Type, events.CHANGE_TIMED_OUT)
 					}
 			}
 
+			pendingHostChanges := 0
+			for _, host := range state_store.GetAllHosts() {
+				pendingHostChanges += len(host.Changes)
+			}
+			metrics.Trainer.Set("orca_pending_changes", metrics.Labels{"kind": "application"}, float64(pendingHostChanges))
+			metrics.Trainer.Set("orca_pending_changes", metrics.Labels{"kind": "server"}, float64(len(cloud_provider.Changes)))
+
 			/* Can we actually run the planner ? */
 			if(state_store.HasChanges() || cloud_provider.HasChanges()){
 				fmt.Println("Still have unresolved changes, waiting")
 				continue;
 			}
 
-			changes := plannerEngine.Plan((*store), (*state_store))
-			fmt.Println("Changes from planner: %+v", changes)
-			for _, change := range changes {
-				if change.Type == "new_server" {
-					/* Add new server */
-					cloud_provider.ActionChange(&model.ChangeServer{
-						Id:uuid.NewV4().String(),
-						Type: "new_server",
-						Time:time.Now().Format(time.RFC3339Nano),
-						RequiresReliableInstance: change.RequiresReliableInstance,
-					})
-
-					continue
+			store.WriteLock()
+			if autoscaler.Scale(store, state_store) {
+				if err := store.Save(); err != nil {
+					Logger.Logger.Errorf("Could not save the configuration - %s", err)
 				}
-				if change.Type == "add_application" || change.Type == "remove_application" {
-					/* Add new server */
-					host, _ := state_store.GetConfiguration(change.HostId)
-					app, _ := store.GetConfiguration(change.ApplicationName)
-					host.Changes = append(host.Changes, model.ChangeApplication{
-						Id: uuid.NewV4().String(),
-						Type: change.Type,
-						HostId: host.Id,
-						AppConfig: app.GetLatestConfiguration(),
-						Name: change.ApplicationName,
-						Time:time.Now().Format(time.RFC3339Nano),
-					})
+			}
+			store.WriteUnlock()
 
-					continue
-				}
-				if change.Type == "kill_server" {
-					cloud_provider.ActionChange(&model.ChangeServer{
-						Id:uuid.NewV4().String(),
-						Type: "remove",
-						Time:time.Now().Format(time.RFC3339Nano),
-					})
-					continue
-				}
+			planningStart := time.Now()
+			store.ReadLock()
+			changes := plannerEngine.Plan((*store), (*state_store))
+			store.ReadUnlock()
+			metrics.Trainer.ObserveDuration("orca_planning_duration_seconds", planningStart)
+			fmt.Printf("Changes from planner: %+v\n", changes)
+			for _, change := range changes {
+				events.Cluster.Publish(events.Event{
+					Type: events.EVENT_PLANNING,
+					HostId: change.HostId,
+					Application: change.ApplicationName,
+					Details: map[string]string{"change": change.Id, "type": change.Type},
+				})
 			}
+			controller.Handle(changes)
 		}
 	}()
 
-	api := api.Api{}
-	api.Init(*apiPort, store, state_store)
+	api.Init(settings.Api.ListenAddress, store, state_store, plannerEngine, controller, authenticator)
 
 }
 
+/* Instances a load balancer sends traffic to, these are drained before they are removed */
+func isBehindLoadBalancer(host *model.Host, app *model.ApplicationConfiguration) bool {
+	for _, running := range host.Apps {
+		if running.Name != app.Name {
+			continue
+		}
+		config, ok := app.Config[running.Version]
+		if ok && config.LoadBalancer != "" && running.IsHealthy(config) {
+			return true
+		}
+	}
+	return false
+}
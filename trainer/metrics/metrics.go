@@ -0,0 +1,149 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TYPE_COUNTER = "counter"
+	TYPE_GAUGE   = "gauge"
+	TYPE_SUMMARY = "summary"
+)
+
+type Labels map[string]string
+
+type family struct {
+	name   string
+	kind   string
+	help   string
+	values map[string]float64
+}
+
+/* Just enough of the Prometheus text format for the trainer, no client library needed */
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+	order    []string
+}
+
+/* Internals of the trainer, the host metrics are collected when scraped */
+var Trainer Registry
+
+func (registry *Registry) Describe(name string, kind string, help string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.describe(name, kind, help)
+}
+
+func (registry *Registry) describe(name string, kind string, help string) *family {
+	if registry.families == nil {
+		registry.families = make(map[string]*family)
+	}
+	if existing, ok := registry.families[name]; ok {
+		return existing
+	}
+	created := &family{name: name, kind: kind, help: help, values: make(map[string]float64)}
+	registry.families[name] = created
+	registry.order = append(registry.order, name)
+	return created
+}
+
+func (registry *Registry) Set(name string, labels Labels, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.describe(name, TYPE_GAUGE, "").values[renderLabels(labels)] = value
+}
+
+func (registry *Registry) Add(name string, labels Labels, delta float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.describe(name, TYPE_COUNTER, "").values[renderLabels(labels)] += delta
+}
+
+/* Summaries are exported as _sum and _count only, that is all rate() needs */
+func (registry *Registry) Observe(name string, labels Labels, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	summary := registry.describe(name, TYPE_SUMMARY, "")
+	summary.values["_sum" + renderLabels(labels)] += value
+	summary.values["_count" + renderLabels(labels)] += 1
+}
+
+func (registry *Registry) ObserveDuration(name string, start time.Time) {
+	registry.Observe(name, nil, time.Since(start).Seconds())
+}
+
+/* Gauges that are set as a whole, e.g. per host values of hosts that are gone should disappear */
+func (registry *Registry) Reset(name string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if existing, ok := registry.families[name]; ok {
+		existing.values = make(map[string]float64)
+	}
+}
+
+func (registry *Registry) WriteText(w io.Writer) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, name := range registry.order {
+		family := registry.families[name]
+		if family.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, family.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.kind)
+
+		series := []string{}
+		for labels := range family.values {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(family.values[labels], 'g', -1, 64))
+		}
+	}
+}
+
+func renderLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rendered := []string{}
+	for _, key := range keys {
+		value := strings.Replace(labels[key], "\\", "\\\\", -1)
+		value = strings.Replace(value, "\"", "\\\"", -1)
+		value = strings.Replace(value, "\n", "\\n", -1)
+		rendered = append(rendered, key + "=\"" + value + "\"")
+	}
+	return "{" + strings.Join(rendered, ",") + "}"
+}
@@ -19,7 +19,9 @@ along with Orca.  If not, see <http://www.gnu.org/licenses/>.
 package model
 
 import (
+	"sort"
 	"strconv"
+	"time"
 )
 
 type ChangeApplication struct {
@@ -39,18 +41,58 @@ type ChangeServer struct {
 	Time string
 	NewHostId string
 	RequiresReliableInstance bool
+	/* The host to remove */
+	HostId string
 }
 
+/* What a host can take, in the same units as the AppNeeds. Zero if the host didn't report it */
 type HostResources struct {
-
+	CpuCapacity     CpuNeeds
+	MemoryCapacity  MemoryNeeds
+	NetworkCapacity NetworkNeeds
 }
 
+const (
+	HEALTH_HEALTHY   = "healthy"
+	HEALTH_UNHEALTHY = "unhealthy"
+	/* Within the start period of the health checks */
+	HEALTH_STARTING  = "starting"
+)
+
 type Application struct {
 	Name     string
 	State    string
 	Version  string
 	ChangeId string
 	Metrics  string
+	/* Result of the health checks of the version, empty if it has none or the host doesn't run them */
+	Health   string
+	/* Set by the trainer when it first sees this version running on the host */
+	Started  string
+}
+
+/* Running and passing its health checks. Versions without health checks only need to be running */
+func (application *Application) IsHealthy(config VersionConfig) bool {
+	if application.State != "running" {
+		return false
+	}
+	if len(config.HealthChecks) == 0 {
+		return application.Health == "" || application.Health == HEALTH_HEALTHY
+	}
+	return application.Health == HEALTH_HEALTHY
+}
+
+/* Not reported healthy yet but still within the start period. Afterwards the instance counts as unhealthy, a host that
+   never reports the health would stall the deployment otherwise */
+func (application *Application) IsStarting(config VersionConfig) bool {
+	if application.State != "running" || len(config.HealthChecks) == 0 || (application.Health != HEALTH_STARTING && application.Health != "") {
+		return false
+	}
+	started, err := time.Parse(time.RFC3339Nano, application.Started)
+	if err != nil {
+		return true
+	}
+	return time.Since(started) < config.StartPeriod()
 }
 
 type ApplicationStateFromHost struct {
@@ -68,6 +110,9 @@ type HostCheckinDataPackage struct {
 	State          []ApplicationStateFromHost
 	ChangesApplied map[string]bool
 	Metrics        map[string]Metric
+	Resources      HostResources
+	/* The address the load balancers use, the trainer uses the address of the checkin if empty */
+	Ip             string
 }
 
 type Host struct {
@@ -78,6 +123,43 @@ type Host struct {
 	Apps      []Application
 	Changes   []ChangeApplication
 	Resources HostResources
+	/* Latest metrics per application from the last checkin */
+	Metrics   map[string]Metric
+	Ip        string
+	/* Removals held back until the load balancers stopped sending traffic to the instance */
+	Draining  []DrainingApplication
+	/* Set by the operators, they win over the labels from the cloud provider */
+	Labels      map[string]string
+	CloudLabels map[string]string
+}
+
+const LABEL_ZONE = "zone"
+
+func (host *Host) GetLabels() map[string]string {
+	labels := make(map[string]string)
+	for key, value := range host.CloudLabels {
+		labels[key] = value
+	}
+	for key, value := range host.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+type DrainingApplication struct {
+	Name   string
+	Since  string
+	Until  string
+	Change ChangeApplication
+}
+
+func (host *Host) IsDraining(name string) bool {
+	for _, draining := range host.Draining {
+		if draining.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (host *Host) HasApp(name string, version string) bool {
@@ -89,6 +171,25 @@ func (host *Host) HasApp(name string, version string) bool {
 	return false;
 }
 
+/* Any version in any state */
+func (host *Host) HasAnyVersionOfApp(name string) bool {
+	for _, application := range host.Apps {
+		if application.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (host *Host) HasChange(changeId string) bool {
+	for _, change := range host.Changes {
+		if change.Id == changeId {
+			return true
+		}
+	}
+	return false
+}
+
 
 type DockerConfig struct {
 	Tag        string
@@ -127,6 +228,44 @@ type AppNeeds struct {
 	NetworkNeeds NetworkNeeds
 }
 
+const (
+	HEALTH_CHECK_HTTP    = "http"
+	HEALTH_CHECK_TCP     = "tcp"
+	HEALTH_CHECK_COMMAND = "command"
+)
+
+/* Run by the host agent. An instance becomes healthy after HealthyThreshold passing checks in a row and unhealthy
+   after UnhealthyThreshold failing ones, failures within StartPeriodSeconds of the start don't count */
+type HealthCheck struct {
+	Type               string
+	/* http only, a 2xx or 3xx response passes */
+	Path               string
+	/* http and tcp, the container port */
+	Port               string
+	/* command only, run inside the container, exit code 0 passes */
+	Command            []string
+	IntervalSeconds    int
+	TimeoutSeconds     int
+	StartPeriodSeconds int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+/* The start period of the slowest check plus the passing checks it needs afterwards */
+func (config VersionConfig) StartPeriod() time.Duration {
+	longest := 0
+	for _, check := range config.HealthChecks {
+		threshold := check.HealthyThreshold
+		if threshold < 1 {
+			threshold = 1
+		}
+		if period := check.StartPeriodSeconds + check.IntervalSeconds * threshold; period > longest {
+			longest = period
+		}
+	}
+	return time.Duration(longest) * time.Second
+}
+
 type VersionConfig struct {
 	Version string
 	DockerConfig	     DockerConfig
@@ -137,6 +276,24 @@ type VersionConfig struct {
 	VolumeMappings       []VolumeMapping
 	EnvironmentVariables []EnvironmentVariable
 	Files                []File
+	HealthChecks         []HealthCheck
+}
+
+const (
+	AUTOSCALING_CPU    = "cpu"
+	AUTOSCALING_MEMORY = "memory"
+)
+
+/* The autoscaler sets DesiredDeployment so the instances use TargetUtilization percent of the
+   cpu or memory Needs of the latest version on average */
+type AutoscalingPolicy struct {
+	Metric                   string
+	TargetUtilization        float64
+	MaxDeployment            int
+	/* The average over this window is used */
+	WindowSeconds            int
+	ScaleUpCooldownSeconds   int
+	ScaleDownCooldownSeconds int
 }
 
 type ApplicationConfiguration struct {
@@ -144,6 +301,48 @@ type ApplicationConfiguration struct {
 	MinDeployment int
 	DesiredDeployment int
 	Config map[string]VersionConfig
+
+	/* Set when the application is deleted, the planner removes all instances before the configuration is dropped */
+	Decommission bool
+
+	/* nil disables autoscaling */
+	Autoscaling *AutoscalingPolicy
+
+	Placement PlacementRules
+
+	/* Not deployed before these are running and healthy */
+	Dependencies []Dependency
+}
+
+const (
+	DEPENDENCY_CLUSTER = "cluster"
+	DEPENDENCY_HOST    = "host"
+)
+
+type Dependency struct {
+	Application string
+	/* "cluster" needs a healthy instance anywhere, "host" one on the same host (e.g. a sidecar). Empty means cluster */
+	Scope       string
+}
+
+/* Where the planner may put instances. Instances of the same application never share a host */
+type PlacementRules struct {
+	/* Only hosts that have all of these labels */
+	Labels       map[string]string
+	/* New instances go to the zone with the fewest instances */
+	SpreadZones  bool
+	/* Never on a host with one of these applications */
+	AntiAffinity []string
+	/* Only on hosts that run all of these applications */
+	Affinity     []string
+}
+
+/* The number of instances the planner works towards, never less than MinDeployment */
+func (app *ApplicationConfiguration) TargetDeployment() int {
+	if app.DesiredDeployment > app.MinDeployment {
+		return app.DesiredDeployment
+	}
+	return app.MinDeployment
 }
 
 func (app *ApplicationConfiguration) GetLatestVersion() string {
@@ -158,6 +357,20 @@ func (app *ApplicationConfiguration) GetLatestVersion() string {
 	return strconv.Itoa(version)
 }
 
+/* Versions in ascending order */
+func (app *ApplicationConfiguration) GetVersions() []string {
+	versions := []string{}
+	for v, _ := range app.Config {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		iversion, _ := strconv.Atoi(versions[i])
+		jversion, _ := strconv.Atoi(versions[j])
+		return iversion < jversion
+	})
+	return versions
+}
+
 func (app *ApplicationConfiguration) GetNextVersion() string {
 	ivalue, _ := strconv.Atoi(app.GetLatestVersion())
 	return strconv.Itoa(ivalue + 1)
@@ -0,0 +1,147 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+/* Utilization within this fraction of the target is close enough, keeps the deployment from flapping */
+const AUTOSCALING_TOLERANCE = 0.1
+
+const DEFAULT_AUTOSCALING_WINDOW = time.Minute * 5
+
+/* Sets DesiredDeployment of the applications with an autoscaling policy from the metrics history,
+   the planner then works towards it like towards any other deployment size */
+type Autoscaler struct {
+	lastScaled map[string]time.Time
+}
+
+type scalingDecision struct {
+	from        int
+	to          int
+	utilization float64
+	running     int
+}
+
+func (autoscaler *Autoscaler) Init() {
+	autoscaler.lastScaled = make(map[string]time.Time)
+}
+
+/* Returns true if any application was scaled and the configuration needs saving */
+func (autoscaler *Autoscaler) Scale(configurationStore *configuration.ConfigurationStore, currentState *state.StateStore) bool {
+	scaled := false
+	for name, application := range configurationStore.GetAllConfiguration() {
+		if application.Autoscaling == nil || application.Decommission {
+			continue
+		}
+		decision, ok := autoscaler.evaluate(name, application, currentState)
+		if !ok {
+			continue
+		}
+
+		policy := application.Autoscaling
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+			"message": fmt.Sprintf("Autoscaling application %s from %d to %d instances, %s utilization of %d running instances is %.1f%% with a target of %.1f%%",
+				name, decision.from, decision.to, policy.Metric, decision.running, decision.utilization, policy.TargetUtilization),
+			"application": name,
+			"from": strconv.Itoa(decision.from),
+			"to": strconv.Itoa(decision.to),
+		}})
+
+		application.DesiredDeployment = decision.to
+		autoscaler.lastScaled[name] = time.Now()
+		scaled = true
+	}
+	return scaled
+}
+
+func (autoscaler *Autoscaler) evaluate(name string, application *model.ApplicationConfiguration, currentState *state.StateStore) (scalingDecision, bool) {
+	policy := application.Autoscaling
+	if policy.TargetUtilization <= 0 || policy.MaxDeployment <= 0 || (policy.Metric != model.AUTOSCALING_CPU && policy.Metric != model.AUTOSCALING_MEMORY) {
+		return scalingDecision{}, false
+	}
+
+	running := 0
+	for _, host := range currentState.GetAllHosts() {
+		if host.State == state.HOST_LOST {
+			continue
+		}
+		for _, app := range host.Apps {
+			if app.Name == name && app.State == "running" {
+				running++
+			}
+		}
+	}
+	if running == 0 {
+		return scalingDecision{}, false
+	}
+
+	window := DEFAULT_AUTOSCALING_WINDOW
+	if policy.WindowSeconds > 0 {
+		window = time.Second * time.Duration(policy.WindowSeconds)
+	}
+	average, ok := currentState.History.ApplicationAverage(name, window)
+	if !ok {
+		return scalingDecision{}, false
+	}
+
+	needs := application.Config[application.GetLatestVersion()].Needs
+	usage, needed := average.CpuUsage, float64(needs.CpuNeeds)
+	if policy.Metric == model.AUTOSCALING_MEMORY {
+		usage, needed = average.MemoryUsage, float64(needs.MemoryNeeds)
+	}
+	if needed <= 0 {
+		return scalingDecision{}, false
+	}
+
+	utilization := usage / needed * 100
+	if math.Abs(utilization / policy.TargetUtilization - 1) <= AUTOSCALING_TOLERANCE {
+		return scalingDecision{}, false
+	}
+
+	desired := int(math.Ceil(float64(running) * utilization / policy.TargetUtilization))
+	if desired > policy.MaxDeployment {
+		desired = policy.MaxDeployment
+	}
+	if desired < application.MinDeployment {
+		desired = application.MinDeployment
+	}
+
+	current := application.TargetDeployment()
+	if desired == current {
+		return scalingDecision{}, false
+	}
+
+	cooldown := time.Second * time.Duration(policy.ScaleUpCooldownSeconds)
+	if desired < current {
+		cooldown = time.Second * time.Duration(policy.ScaleDownCooldownSeconds)
+	}
+	if last, ok := autoscaler.lastScaled[name]; ok && time.Since(last) < cooldown {
+		return scalingDecision{}, false
+	}
+
+	return scalingDecision{from: current, to: desired, utilization: utilization, running: running}, true
+}
@@ -0,0 +1,102 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"testing"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+/* Needs 100 cpu per instance, scales to 50% between 1 and 5 instances */
+func autoscaledApplication(desired int) *model.ApplicationConfiguration {
+	application := testApplication("a", 1)
+	application.DesiredDeployment = desired
+	config := application.Config["1"]
+	config.Needs.CpuNeeds = 100
+	application.Config["1"] = config
+	application.Autoscaling = &model.AutoscalingPolicy{Metric: model.AUTOSCALING_CPU, TargetUtilization: 50, MaxDeployment: 5, ScaleDownCooldownSeconds: 3600}
+	return application
+}
+
+func TestAutoscale(t *testing.T) {
+	tests := []struct {
+		name         string
+		desired      int
+		decommission bool
+		hosts        []testHost
+		/* Cpu usage of a reported by each host */
+		cpu          map[string]uint64
+		scaled       bool
+		to           int
+	}{
+		{"scale up", 2, false, []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}}},
+			map[string]uint64{"h1": 100, "h2": 100}, true, 4},
+		{"within the tolerance", 2, false, []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}}},
+			map[string]uint64{"h1": 52, "h2": 52}, false, 2},
+		{"capped at the maximum", 2, false, []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}}},
+			map[string]uint64{"h1": 200, "h2": 200}, true, 5},
+		{"scale down to the minimum", 4, false, []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}}},
+			map[string]uint64{"h1": 1, "h2": 1}, true, 1},
+		{"no samples", 2, false, []testHost{{id: "h1", apps: []string{"a"}}}, map[string]uint64{}, false, 2},
+		{"nothing running", 2, false, []testHost{{id: "h1"}}, map[string]uint64{"h1": 100}, false, 2},
+		{"lost hosts are not counted", 1, false, []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}, state: state.HOST_LOST}},
+			map[string]uint64{"h1": 100}, true, 2},
+		{"decommissioned", 2, true, []testHost{{id: "h1", apps: []string{"a"}}}, map[string]uint64{"h1": 100}, false, 2},
+	}
+	for _, test := range tests {
+		application := autoscaledApplication(test.desired)
+		application.Decommission = test.decommission
+		configurationStore := testConfiguration(application)
+		currentState := testState(test.hosts...)
+		for hostId, cpu := range test.cpu {
+			currentState.History.Record(hostId, map[string]model.Metric{"a": {CpuUsage: cpu}})
+		}
+
+		autoscaler := &Autoscaler{}
+		autoscaler.Init()
+		scaled := autoscaler.Scale(&configurationStore, &currentState)
+		if scaled != test.scaled || application.DesiredDeployment != test.to {
+			t.Errorf("%s: expected scaled %t to %d, got %t to %d", test.name, test.scaled, test.to, scaled, application.DesiredDeployment)
+		}
+	}
+}
+
+func TestAutoscaleCooldown(t *testing.T) {
+	application := autoscaledApplication(2)
+	configurationStore := testConfiguration(application)
+	currentState := testState(testHost{id: "h1", apps: []string{"a"}}, testHost{id: "h2", apps: []string{"a"}})
+	currentState.History.Record("h1", map[string]model.Metric{"a": {CpuUsage: 100}})
+	currentState.History.Record("h2", map[string]model.Metric{"a": {CpuUsage: 100}})
+
+	autoscaler := &Autoscaler{}
+	autoscaler.Init()
+	if !autoscaler.Scale(&configurationStore, &currentState) || application.DesiredDeployment != 4 {
+		t.Fatalf("expected the application to be scaled up to 4, got %d", application.DesiredDeployment)
+	}
+
+	/* The load drops to an average of 10%, scaling down waits for the cooldown of an hour */
+	for i := 0; i < 8; i++ {
+		currentState.History.Record("h1", map[string]model.Metric{"a": {CpuUsage: 0}})
+		currentState.History.Record("h2", map[string]model.Metric{"a": {CpuUsage: 0}})
+	}
+	if autoscaler.Scale(&configurationStore, &currentState) || application.DesiredDeployment != 4 {
+		t.Errorf("expected the cooldown to hold the deployment at 4, got %d", application.DesiredDeployment)
+	}
+}
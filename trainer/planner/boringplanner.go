@@ -19,69 +19,127 @@ along with Orca.  If not, see <http://www.gnu.org/licenses/>.
 package planner
 
 import (
+	"sort"
+	"strconv"
 	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
 	"gatoor/orca/trainer/state"
 	"github.com/twinj/uuid"
 )
 
 type BoringPlanner struct {
+	consolidation ConsolidationSettings
 }
 
-func (*BoringPlanner) Init() {
-
+/* MinimumFleetSize defaults to 1, the Host*Capacity parameters are used for hosts that don't report their resources */
+func (planner *BoringPlanner) Init(parameters map[string]string) {
+	planner.consolidation = ConsolidationSettings{MinimumFleetSize: 1}
+	if value, err := strconv.Atoi(parameters["MinimumFleetSize"]); err == nil {
+		planner.consolidation.MinimumFleetSize = value
+	}
+	if value, err := strconv.ParseFloat(parameters["HostCpuCapacity"], 32); err == nil {
+		planner.consolidation.DefaultCapacity.CpuCapacity = model.CpuNeeds(value)
+	}
+	if value, err := strconv.ParseFloat(parameters["HostMemoryCapacity"], 32); err == nil {
+		planner.consolidation.DefaultCapacity.MemoryCapacity = model.MemoryNeeds(value)
+	}
+	if value, err := strconv.ParseFloat(parameters["HostNetworkCapacity"], 32); err == nil {
+		planner.consolidation.DefaultCapacity.NetworkCapacity = model.NetworkNeeds(value)
+	}
 }
 
-func (*BoringPlanner) Plan(configurationStore configuration.ConfigurationStore, currentState state.StateStore) ([]PlanningChange) {
+func (planner *BoringPlanner) Plan(configurationStore configuration.ConfigurationStore, currentState state.StateStore) ([]PlanningChange) {
 	ret := make([]PlanningChange, 0)
 
 	requiresMinServer := false;
+	reserved := reservations{}
 
 	for name, applicationConfiguration := range configurationStore.GetAllConfiguration() {
+		if applicationConfiguration.Decommission {
+			ret = append(ret, planDecommission(name, currentState)...)
+			continue
+		}
+
+		latestVersion := applicationConfiguration.GetLatestVersion()
+		latestConfig := applicationConfiguration.Config[latestVersion]
+
+		/* Only healthy instances on running hosts count towards the deployment, starting ones are waited for before adding more */
 		currentCount := 0
-		for _, hostEntity := range currentState.GetAllHosts() {
+		startingCount := 0
+		healthyHosts := []string{}
+		unhealthyHosts := []string{}
+		for _, hostEntity := range emptiestHostsFirst(currentState) {
 			for _, runningApplicationState := range hostEntity.Apps {
-				if runningApplicationState.Name == name && runningApplicationState.Version == applicationConfiguration.GetLatestVersion() {
-					if runningApplicationState.State == "running" {
-						currentCount += 1
-					}
+				if runningApplicationState.Name != name || runningApplicationState.Version != latestVersion {
+					continue
+				}
+				if runningApplicationState.IsHealthy(latestConfig) {
+					currentCount += 1
+					healthyHosts = append(healthyHosts, hostEntity.Id)
+				} else if runningApplicationState.IsStarting(latestConfig) {
+					startingCount += 1
+				} else if runningApplicationState.State == "running" {
+					unhealthyHosts = append(unhealthyHosts, hostEntity.Id)
 				}
 			}
 		}
 
-		if currentCount < applicationConfiguration.MinDeployment {
-			foundServer := false
+		targetCount := applicationConfiguration.TargetDeployment()
+
+		/* Nothing is deployed before the dependencies are up */
+		if currentCount + startingCount < targetCount && clusterDependenciesReady(configurationStore, currentState, applicationConfiguration) {
+			candidates := []*model.Host{}
 			for _, hostEntity := range currentState.GetAllHosts() {
-				if !hostEntity.HasApp(name, applicationConfiguration.GetLatestVersion()){
-					change := PlanningChange{
-						Type: "add_application",
-						ApplicationName: name,
-						HostId: hostEntity.Id,
-						Id:uuid.NewV4().String(),
-					}
-
-					ret = append(ret, change)
-					foundServer = true
-					break
+				if hostEntity.State != state.HOST_RUNNING {
+					continue
+				}
+				if !hostEntity.HasApp(name, latestVersion) && canPlace(configurationStore, hostEntity, name, applicationConfiguration, latestConfig, reserved) {
+					candidates = append(candidates, hostEntity)
 				}
 			}
 
-			if !foundServer {
+			if len(candidates) > 0 {
+				target := candidates[0]
+				if applicationConfiguration.Placement.SpreadZones {
+					target = leastUsedZone(currentState, name, candidates)
+				}
+				reserved.add(target.Id, name)
+				change := PlanningChange{
+					Type: "add_application",
+					ApplicationName: name,
+					HostId: target.Id,
+					Id:uuid.NewV4().String(),
+				}
+
+				ret = append(ret, change)
+			} else if newServerCouldHost(applicationConfiguration) {
 				requiresMinServer = true
 			}
 		}
 
-		if currentCount > applicationConfiguration.MinDeployment {
-			for _, hostEntity := range currentState.GetAllHosts() {
-				if hostEntity.HasApp(name, applicationConfiguration.GetLatestVersion()){
-					change := PlanningChange{
-						Type: "remove_application",
-						ApplicationName: name,
-						HostId: hostEntity.Id,
-						Id:uuid.NewV4().String(),
-					}
-
-					ret = append(ret, change)
+		/* Unhealthy instances are replaced first and removed once the deployment is healthy without them */
+		if currentCount >= targetCount {
+			for _, hostId := range unhealthyHosts {
+				ret = append(ret, PlanningChange{
+					Type: "remove_application",
+					ApplicationName: name,
+					HostId: hostId,
+					Id:uuid.NewV4().String(),
+				})
+			}
+		}
+
+		if currentCount > targetCount {
+			/* Only the surplus, scaling in must not take the application down */
+			for _, hostId := range healthyHosts[:currentCount - targetCount] {
+				change := PlanningChange{
+					Type: "remove_application",
+					ApplicationName: name,
+					HostId: hostId,
+					Id:uuid.NewV4().String(),
 				}
+
+				ret = append(ret, change)
 			}
 		}
 	}
@@ -96,5 +154,28 @@ func (*BoringPlanner) Plan(configurationStore configuration.ConfigurationStore,
 		ret = append(ret, change)
 	}
 
+	if len(ret) == 0 {
+		ret = planConsolidation(configurationStore, currentState, planner.consolidation)
+	}
+
 	return ret
 }
+
+/* Removing instances from the emptiest hosts first drains the host the consolidation picked. Lost and terminating
+   hosts are left out, their instances are replaced instead of counted and changes sent to them only time out */
+func emptiestHostsFirst(currentState state.StateStore) []*model.Host {
+	hosts := []*model.Host{}
+	for _, host := range currentState.GetAllHosts() {
+		if host.State != state.HOST_RUNNING {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if len(hosts[i].Apps) != len(hosts[j].Apps) {
+			return len(hosts[i].Apps) < len(hosts[j].Apps)
+		}
+		return hosts[i].Id < hosts[j].Id
+	})
+	return hosts
+}
@@ -0,0 +1,277 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+/* One version running nginx, the ports as "host:container" */
+func testApplication(name string, instances int, ports ...string) *model.ApplicationConfiguration {
+	config := model.VersionConfig{Version: "1", DockerConfig: model.DockerConfig{Repository: "nginx"}}
+	for _, port := range ports {
+		parts := strings.Split(port, ":")
+		config.PortMappings = append(config.PortMappings, model.PortMapping{HostPort: parts[0], ContainerPort: parts[1]})
+	}
+	return &model.ApplicationConfiguration{
+		Name: name,
+		MinDeployment: instances,
+		DesiredDeployment: instances,
+		Config: map[string]model.VersionConfig{"1": config},
+	}
+}
+
+func testConfiguration(applications ...*model.ApplicationConfiguration) configuration.ConfigurationStore {
+	store := configuration.ConfigurationStore{}
+	store.Init("trainer.conf")
+	for _, application := range applications {
+		store.Configurations[application.Name] = application
+	}
+	return store
+}
+
+type testHost struct {
+	id     string
+	labels map[string]string
+	/* Version 1 of these is running */
+	apps   []string
+	/* Running if empty */
+	state  string
+}
+
+/* Lost hosts check in first and are then marked lost, the others check in afterwards */
+func testState(hosts ...testHost) state.StateStore {
+	store := state.StateStore{}
+	store.Init()
+	lost := []testHost{}
+	others := []testHost{}
+	for _, host := range hosts {
+		if host.state == state.HOST_LOST {
+			lost = append(lost, host)
+		} else {
+			others = append(others, host)
+		}
+	}
+	checkin(&store, lost)
+	store.CheckLostHosts(0)
+	checkin(&store, others)
+	for _, host := range hosts {
+		if host.state == state.HOST_TERMINATING {
+			store.MarkTerminating(host.id)
+		}
+	}
+	return store
+}
+
+func checkin(store *state.StateStore, hosts []testHost) {
+	for _, host := range hosts {
+		checkin := model.HostCheckinDataPackage{}
+		for _, name := range host.apps {
+			checkin.State = append(checkin.State, model.ApplicationStateFromHost{Name: name, Application: model.Application{Name: name, Version: "1", State: "running"}})
+		}
+		store.HostCheckin(host.id, checkin)
+		if host.labels != nil {
+			store.SetLabels(host.id, host.labels, "test")
+		}
+	}
+}
+
+func plan(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+	planner := &BoringPlanner{}
+	planner.Init(map[string]string{})
+	return planner.Plan(configurationStore, currentState)
+}
+
+/* "type application host" per change, sorted */
+func sortedChanges(changes []PlanningChange) []string {
+	described := []string{}
+	for _, change := range changes {
+		described = append(described, strings.TrimSpace(change.Type + " " + change.ApplicationName + " " + change.HostId))
+	}
+	sort.Strings(described)
+	return described
+}
+
+/* Host ids of the add_application changes by application */
+func additions(changes []PlanningChange) map[string]string {
+	added := make(map[string]string)
+	for _, change := range changes {
+		if change.Type == "add_application" {
+			added[change.ApplicationName] = change.HostId
+		}
+	}
+	return added
+}
+
+func TestPlanHostPorts(t *testing.T) {
+	tests := []struct {
+		name         string
+		applications []*model.ApplicationConfiguration
+		hosts        []testHost
+		/* Applications that must not end up on the same host */
+		conflicting  []string
+		added        int
+		newServer    bool
+	}{
+		{"same port, one host",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "8080:80")},
+			[]testHost{{id: "h1"}}, []string{"a", "b"}, 1, true},
+		{"same port, two hosts",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "8080:80")},
+			[]testHost{{id: "h1"}, {id: "h2"}}, []string{"a", "b"}, 2, false},
+		{"same port with a leading zero",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "08080:80")},
+			[]testHost{{id: "h1"}}, []string{"a", "b"}, 1, true},
+		{"port taken by a running application",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "8080:80")},
+			[]testHost{{id: "h1", apps: []string{"a"}}}, nil, 0, true},
+		{"different ports",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "8081:80")},
+			[]testHost{{id: "h1"}}, nil, 2, false},
+		{"same container port, other host ports",
+			[]*model.ApplicationConfiguration{testApplication("a", 1, "8080:80"), testApplication("b", 1, "8081:80"), testApplication("c", 1)},
+			[]testHost{{id: "h1"}}, nil, 3, false},
+	}
+	for _, test := range tests {
+		/* The applications are planned in map order, every order has to hold */
+		for run := 0; run < 10; run++ {
+			changes := plan(testConfiguration(test.applications...), testState(test.hosts...))
+			added := additions(changes)
+			if len(added) != test.added {
+				t.Errorf("%s: expected %d applications to be added, got %v", test.name, test.added, sortedChanges(changes))
+				break
+			}
+			if len(test.conflicting) == 2 && added[test.conflicting[0]] != "" && added[test.conflicting[0]] == added[test.conflicting[1]] {
+				t.Errorf("%s: conflicting applications placed on the same host, got %v", test.name, sortedChanges(changes))
+				break
+			}
+			newServer := false
+			for _, change := range changes {
+				newServer = newServer || change.Type == "new_server"
+			}
+			if newServer != test.newServer {
+				t.Errorf("%s: expected a new server %t, got %v", test.name, test.newServer, sortedChanges(changes))
+				break
+			}
+		}
+	}
+}
+
+func withPlacement(application *model.ApplicationConfiguration, placement model.PlacementRules) *model.ApplicationConfiguration {
+	application.Placement = placement
+	return application
+}
+
+func TestPlanPlacement(t *testing.T) {
+	ssd := map[string]string{"disk": "ssd"}
+	tests := []struct {
+		name         string
+		applications []*model.ApplicationConfiguration
+		hosts        []testHost
+		/* The hosts each added application may go to, the other applications must not be added */
+		placed       map[string][]string
+		added        int
+		/* Applications that must not end up on the same host */
+		conflicting  []string
+	}{
+		{"labels",
+			[]*model.ApplicationConfiguration{withPlacement(testApplication("a", 1), model.PlacementRules{Labels: ssd})},
+			[]testHost{{id: "h1"}, {id: "h2", labels: ssd}, {id: "h3", labels: map[string]string{"disk": "hdd"}}},
+			map[string][]string{"a": {"h2"}}, 1, nil},
+		{"no host with the labels",
+			[]*model.ApplicationConfiguration{withPlacement(testApplication("a", 1), model.PlacementRules{Labels: ssd})},
+			[]testHost{{id: "h1"}},
+			map[string][]string{}, 0, nil},
+		{"affinity",
+			[]*model.ApplicationConfiguration{testApplication("a", 1), withPlacement(testApplication("b", 1), model.PlacementRules{Affinity: []string{"a"}})},
+			[]testHost{{id: "h1"}, {id: "h2", apps: []string{"a"}}, {id: "h3"}},
+			map[string][]string{"b": {"h2"}}, 1, nil},
+		{"anti-affinity to a running application",
+			[]*model.ApplicationConfiguration{testApplication("a", 1), withPlacement(testApplication("b", 1), model.PlacementRules{AntiAffinity: []string{"a"}})},
+			[]testHost{{id: "h1", apps: []string{"a"}}, {id: "h2"}},
+			map[string][]string{"b": {"h2"}}, 1, nil},
+		{"anti-affinity of a running application",
+			[]*model.ApplicationConfiguration{withPlacement(testApplication("a", 1), model.PlacementRules{AntiAffinity: []string{"b"}}), testApplication("b", 1)},
+			[]testHost{{id: "h1", apps: []string{"a"}}, {id: "h2"}},
+			map[string][]string{"b": {"h2"}}, 1, nil},
+		{"anti-affinity in the same run, one host",
+			[]*model.ApplicationConfiguration{withPlacement(testApplication("a", 1), model.PlacementRules{AntiAffinity: []string{"b"}}), testApplication("b", 1)},
+			[]testHost{{id: "h1"}},
+			map[string][]string{"a": {"h1"}, "b": {"h1"}}, 1, []string{"a", "b"}},
+		{"anti-affinity in the same run, two hosts",
+			[]*model.ApplicationConfiguration{testApplication("a", 1), withPlacement(testApplication("b", 1), model.PlacementRules{AntiAffinity: []string{"a"}})},
+			[]testHost{{id: "h1"}, {id: "h2"}},
+			map[string][]string{"a": {"h1", "h2"}, "b": {"h1", "h2"}}, 2, []string{"a", "b"}},
+		{"spread zones",
+			[]*model.ApplicationConfiguration{withPlacement(testApplication("a", 2), model.PlacementRules{SpreadZones: true})},
+			[]testHost{{id: "h1", labels: map[string]string{"zone": "x"}, apps: []string{"a"}}, {id: "h2", labels: map[string]string{"zone": "x"}}, {id: "h3", labels: map[string]string{"zone": "y"}}},
+			map[string][]string{"a": {"h3"}}, 1, nil},
+	}
+	for _, test := range tests {
+		for run := 0; run < 10; run++ {
+			changes := plan(testConfiguration(test.applications...), testState(test.hosts...))
+			added := additions(changes)
+			failed := false
+			for name, host := range added {
+				if !contains(test.placed[name], host) {
+					failed = true
+				}
+			}
+			if len(test.conflicting) == 2 {
+				failed = failed || (added[test.conflicting[0]] != "" && added[test.conflicting[0]] == added[test.conflicting[1]])
+			}
+			failed = failed || len(added) != test.added
+			if failed {
+				t.Errorf("%s: expected the placement %v, got %v", test.name, test.placed, sortedChanges(changes))
+				break
+			}
+		}
+	}
+}
+
+func TestPlanDecommission(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []testHost
+		changes []string
+	}{
+		{"running hosts", []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}}, {id: "h3"}},
+			[]string{"remove_application a h1", "remove_application a h2"}},
+		{"lost and terminating hosts are left out", []testHost{{id: "h1", apps: []string{"a"}}, {id: "h2", apps: []string{"a"}, state: state.HOST_LOST}, {id: "h3", apps: []string{"a"}, state: state.HOST_TERMINATING}},
+			[]string{"remove_application a h1"}},
+		{"only on lost and terminating hosts", []testHost{{id: "h1", apps: []string{"a"}, state: state.HOST_LOST}, {id: "h2", apps: []string{"a"}, state: state.HOST_TERMINATING}},
+			[]string{"delete_application a"}},
+		{"no instances left", []testHost{{id: "h1"}},
+			[]string{"delete_application a"}},
+	}
+	for _, test := range tests {
+		application := testApplication("a", 1)
+		application.Decommission = true
+		changes := sortedChanges(plan(testConfiguration(application), testState(test.hosts...)))
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.changes, changes)
+		}
+	}
+}
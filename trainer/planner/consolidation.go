@@ -0,0 +1,176 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"sort"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+	"github.com/twinj/uuid"
+)
+
+/* Tuning of the scale in, all of it comes from the planner parameters */
+type ConsolidationSettings struct {
+	/* Never go below this many hosts */
+	MinimumFleetSize int
+	/* Used for hosts that don't report their resources, zero disables moving applications */
+	DefaultCapacity  model.HostResources
+}
+
+type hostLoad struct {
+	host  *model.Host
+	needs model.AppNeeds
+}
+
+/* Only runs when the cluster is otherwise settled. Empty hosts are killed, otherwise the least loaded host is drained
+   if everything on it fits on the other hosts: its applications are added elsewhere, the surplus instances are then
+   removed from the emptiest hosts first, and once it's empty it is killed on a later run. One host at a time */
+func planConsolidation(configurationStore configuration.ConfigurationStore, currentState state.StateStore, settings ConsolidationSettings) []PlanningChange {
+	loads := []hostLoad{}
+	for _, host := range currentState.GetAllHosts() {
+		if host.State != state.HOST_RUNNING {
+			continue
+		}
+		loads = append(loads, hostLoad{host: host, needs: hostNeeds(configurationStore, host)})
+	}
+
+	if len(loads) <= settings.MinimumFleetSize {
+		return []PlanningChange{}
+	}
+
+	sort.Slice(loads, func(i, j int) bool {
+		if len(loads[i].host.Apps) != len(loads[j].host.Apps) {
+			return len(loads[i].host.Apps) < len(loads[j].host.Apps)
+		}
+		return loads[i].host.Id < loads[j].host.Id
+	})
+
+	candidate := loads[0]
+	if len(candidate.host.Apps) == 0 && len(candidate.host.Changes) == 0 {
+		return []PlanningChange{{
+			Type: "kill_server",
+			HostId: candidate.host.Id,
+			Id: uuid.NewV4().String(),
+		}}
+	}
+
+	return planDrain(configurationStore, candidate, loads[1:], settings.DefaultCapacity)
+}
+
+/* Adds every application of the candidate to other hosts, nothing if any of them doesn't fit */
+func planDrain(configurationStore configuration.ConfigurationStore, candidate hostLoad, others []hostLoad, defaultCapacity model.HostResources) []PlanningChange {
+	for _, application := range candidate.host.Apps {
+		if application.State != "running" {
+			return []PlanningChange{}
+		}
+	}
+
+	remaining := make(map[string]model.HostResources)
+	for _, other := range others {
+		capacity := other.host.Resources
+		if capacity == (model.HostResources{}) {
+			capacity = defaultCapacity
+		}
+		if capacity == (model.HostResources{}) {
+			continue
+		}
+		remaining[other.host.Id] = model.HostResources{
+			CpuCapacity: capacity.CpuCapacity - other.needs.CpuNeeds,
+			MemoryCapacity: capacity.MemoryCapacity - other.needs.MemoryNeeds,
+			NetworkCapacity: capacity.NetworkCapacity - other.needs.NetworkNeeds,
+		}
+	}
+
+	reserved := reservations{}
+	changes := []PlanningChange{}
+	for _, application := range candidate.host.Apps {
+		/* The new instances get the latest version */
+		config := latestConfig(configurationStore, application.Name)
+		needs := config.Needs
+		applicationConfiguration, err := configurationStore.GetConfiguration(application.Name)
+		if err != nil {
+			return []PlanningChange{}
+		}
+		placed := false
+		for _, other := range others {
+			free, ok := remaining[other.host.Id]
+			if !ok || other.host.HasAnyVersionOfApp(application.Name) || !fits(needs, free) || !hostPortsFree(usedHostPorts(configurationStore, other.host, "", reserved), config) {
+				continue
+			}
+			if !placementAllows(configurationStore, other.host, application.Name, applicationConfiguration, reserved) {
+				continue
+			}
+			reserved.add(other.host.Id, application.Name)
+			remaining[other.host.Id] = model.HostResources{
+				CpuCapacity: free.CpuCapacity - needs.CpuNeeds,
+				MemoryCapacity: free.MemoryCapacity - needs.MemoryNeeds,
+				NetworkCapacity: free.NetworkCapacity - needs.NetworkNeeds,
+			}
+			changes = append(changes, PlanningChange{
+				Type: "add_application",
+				ApplicationName: application.Name,
+				HostId: other.host.Id,
+				Id: uuid.NewV4().String(),
+			})
+			placed = true
+			break
+		}
+		if !placed {
+			return []PlanningChange{}
+		}
+	}
+	return changes
+}
+
+func fits(needs model.AppNeeds, free model.HostResources) bool {
+	return needs.CpuNeeds <= free.CpuCapacity && needs.MemoryNeeds <= free.MemoryCapacity && needs.NetworkNeeds <= free.NetworkCapacity
+}
+
+func hostNeeds(configurationStore configuration.ConfigurationStore, host *model.Host) model.AppNeeds {
+	total := model.AppNeeds{}
+	for _, application := range host.Apps {
+		needs := applicationNeeds(configurationStore, application)
+		total.CpuNeeds += needs.CpuNeeds
+		total.MemoryNeeds += needs.MemoryNeeds
+		total.NetworkNeeds += needs.NetworkNeeds
+	}
+	return total
+}
+
+/* Needs of the version that is actually running */
+func applicationNeeds(configurationStore configuration.ConfigurationStore, application model.Application) model.AppNeeds {
+	return applicationConfig(configurationStore, application).Needs
+}
+
+func applicationConfig(configurationStore configuration.ConfigurationStore, application model.Application) model.VersionConfig {
+	config, err := configurationStore.GetConfiguration(application.Name)
+	if err != nil {
+		return model.VersionConfig{}
+	}
+	return config.Config[application.Version]
+}
+
+func latestConfig(configurationStore configuration.ConfigurationStore, name string) model.VersionConfig {
+	config, err := configurationStore.GetConfiguration(name)
+	if err != nil {
+		return model.VersionConfig{}
+	}
+	return config.Config[config.GetLatestVersion()]
+}
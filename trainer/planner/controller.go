@@ -0,0 +1,300 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"gatoor/orca/trainer/state"
+	"github.com/twinj/uuid"
+)
+
+const (
+	MODE_AUTO    = "auto"
+	MODE_PAUSED  = "paused"
+	MODE_APPROVE = "approve"
+)
+
+const (
+	PROPOSAL_PENDING    = "pending"
+	PROPOSAL_APPROVED   = "approved"
+	PROPOSAL_REJECTED   = "rejected"
+	PROPOSAL_SUPERSEDED = "superseded"
+)
+
+/* How many decided proposals we keep around for the api */
+const MAX_PROPOSAL_HISTORY = 100
+
+type Proposal struct {
+	Id        string
+	Created   string
+	Decided   string
+	DecidedBy string
+	State     string
+	Changes   []PlanningChange
+}
+
+type ModeSettings struct {
+	Mode         string
+	Applications map[string]string
+}
+
+/* Sits between the planner and the dispatching of its changes. Depending on the mode of the cluster
+   and of the applications the changes are dispatched, dropped or queued for an operator to approve */
+type Controller struct {
+	mode             string
+	applicationModes map[string]string
+	proposals        []*Proposal
+	dispatch         func([]PlanningChange)
+	lock             sync.Mutex
+}
+
+func IsValidMode(mode string) bool {
+	return mode == MODE_AUTO || mode == MODE_PAUSED || mode == MODE_APPROVE
+}
+
+func (controller *Controller) Init(mode string, dispatch func([]PlanningChange)) {
+	controller.mode = mode
+	controller.applicationModes = make(map[string]string)
+	controller.proposals = []*Proposal{}
+	controller.dispatch = dispatch
+}
+
+func (controller *Controller) GetModes() ModeSettings {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	applications := make(map[string]string)
+	for name, mode := range controller.applicationModes {
+		applications[name] = mode
+	}
+	return ModeSettings{Mode: controller.mode, Applications: applications}
+}
+
+/* An empty application sets the cluster mode, an empty mode for an application makes it follow the cluster again */
+func (controller *Controller) SetMode(application string, mode string, actor string) error {
+	if application == "" && !IsValidMode(mode) {
+		return errors.New("Unknown mode " + mode)
+	}
+	if application != "" && mode != "" && !IsValidMode(mode) {
+		return errors.New("Unknown mode " + mode)
+	}
+
+	controller.lock.Lock()
+	if application == "" {
+		controller.mode = mode
+	} else if mode == "" {
+		delete(controller.applicationModes, application)
+	} else {
+		controller.applicationModes[application] = mode
+	}
+	controller.lock.Unlock()
+
+	if application == "" {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+			"message": "Planner mode set to " + mode,
+		}})
+	} else {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+			"message": "Planner mode for application " + application + " set to " + mode,
+			"application": application,
+		}})
+	}
+	return nil
+}
+
+/* A paused cluster pauses everything, otherwise the application mode wins over the cluster mode */
+func (controller *Controller) modeFor(application string) string {
+	if controller.mode == MODE_PAUSED || application == "" {
+		return controller.mode
+	}
+	if mode, ok := controller.applicationModes[application]; ok {
+		return mode
+	}
+	return controller.mode
+}
+
+func (controller *Controller) Handle(changes []PlanningChange) {
+	controller.lock.Lock()
+
+	toDispatch := []PlanningChange{}
+	toApprove := []PlanningChange{}
+	for _, change := range changes {
+		switch controller.modeFor(change.ApplicationName) {
+		case MODE_AUTO:
+			toDispatch = append(toDispatch, change)
+		case MODE_APPROVE:
+			toApprove = append(toApprove, change)
+		}
+	}
+
+	if len(toApprove) > 0 {
+		controller.propose(toApprove)
+	}
+	controller.lock.Unlock()
+
+	if len(toDispatch) > 0 {
+		controller.dispatch(toDispatch)
+	}
+}
+
+/* The planner comes up with the same plan on every run until it is acted on, only a different plan replaces the pending one */
+func (controller *Controller) propose(changes []PlanningChange) {
+	if pending := controller.pendingProposal(); pending != nil {
+		if sameChanges(pending.Changes, changes) {
+			return
+		}
+		controller.decide(pending, PROPOSAL_SUPERSEDED, state.ACTOR_TRAINER)
+	}
+
+	proposal := &Proposal{
+		Id: uuid.NewV4().String(),
+		Created: time.Now().Format(time.RFC3339Nano),
+		State: PROPOSAL_PENDING,
+		Changes: changes,
+	}
+	controller.proposals = append(controller.proposals, proposal)
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Details:map[string]string{
+		"message": "Planner proposed " + describeChanges(changes) + ", waiting for approval",
+		"proposal": proposal.Id,
+	}})
+}
+
+func (controller *Controller) pendingProposal() *Proposal {
+	for _, proposal := range controller.proposals {
+		if proposal.State == PROPOSAL_PENDING {
+			return proposal
+		}
+	}
+	return nil
+}
+
+func (controller *Controller) decide(proposal *Proposal, decision string, actor string) {
+	proposal.State = decision
+	proposal.Decided = time.Now().Format(time.RFC3339Nano)
+	proposal.DecidedBy = actor
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Actor: actor, Details:map[string]string{
+		"message": "Proposal " + proposal.Id + " " + decision + ": " + describeChanges(proposal.Changes),
+		"proposal": proposal.Id,
+	}})
+
+	if len(controller.proposals) > MAX_PROPOSAL_HISTORY {
+		controller.proposals = controller.proposals[len(controller.proposals) - MAX_PROPOSAL_HISTORY:]
+	}
+}
+
+func (controller *Controller) GetProposals() []Proposal {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	proposals := []Proposal{}
+	for _, proposal := range controller.proposals {
+		proposals = append(proposals, *proposal)
+	}
+	return proposals
+}
+
+func (controller *Controller) GetProposal(id string) (Proposal, error) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	for _, proposal := range controller.proposals {
+		if proposal.Id == id {
+			return *proposal, nil
+		}
+	}
+	return Proposal{}, errors.New("Could not find proposal")
+}
+
+func (controller *Controller) Approve(id string, actor string) error {
+	controller.lock.Lock()
+	proposal, err := controller.takePending(id)
+	if err != nil {
+		controller.lock.Unlock()
+		return err
+	}
+	controller.decide(proposal, PROPOSAL_APPROVED, actor)
+	controller.lock.Unlock()
+
+	controller.dispatch(proposal.Changes)
+	return nil
+}
+
+func (controller *Controller) Reject(id string, actor string) error {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	proposal, err := controller.takePending(id)
+	if err != nil {
+		return err
+	}
+	controller.decide(proposal, PROPOSAL_REJECTED, actor)
+	return nil
+}
+
+func (controller *Controller) takePending(id string) (*Proposal, error) {
+	for _, proposal := range controller.proposals {
+		if proposal.Id == id {
+			if proposal.State != PROPOSAL_PENDING {
+				return nil, errors.New("Proposal is already " + proposal.State)
+			}
+			return proposal, nil
+		}
+	}
+	return nil, errors.New("Could not find proposal")
+}
+
+/* Ids differ between runs and the planners iterate maps, so compare what the changes do regardless of order */
+func sameChanges(a []PlanningChange, b []PlanningChange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, change := range a {
+		counts[change.Type + "/" + change.HostId + "/" + change.ApplicationName]++
+	}
+	for _, change := range b {
+		key := change.Type + "/" + change.HostId + "/" + change.ApplicationName
+		if counts[key] == 0 {
+			return false
+		}
+		counts[key]--
+	}
+	return true
+}
+
+func describeChanges(changes []PlanningChange) string {
+	description := ""
+	for i, change := range changes {
+		if i > 0 {
+			description += ", "
+		}
+		description += change.Type
+		if change.ApplicationName != "" {
+			description += " " + change.ApplicationName
+		}
+		if change.HostId != "" {
+			description += " on " + change.HostId
+		}
+	}
+	return description
+}
@@ -0,0 +1,52 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"gatoor/orca/trainer/state"
+	"github.com/twinj/uuid"
+)
+
+/* Removes every instance of a decommissioned application, regardless of version and state. Lost and terminating hosts
+   are left out, they would never apply the removal. Once no running host has it anymore the configuration itself is
+   deleted */
+func planDecommission(name string, currentState state.StateStore) []PlanningChange {
+	ret := make([]PlanningChange, 0)
+
+	for _, hostEntity := range currentState.GetAllHosts() {
+		if hostEntity.State == state.HOST_RUNNING && hostEntity.HasAnyVersionOfApp(name) {
+			ret = append(ret, PlanningChange{
+				Type: "remove_application",
+				ApplicationName: name,
+				HostId: hostEntity.Id,
+				Id:uuid.NewV4().String(),
+			})
+		}
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, PlanningChange{
+			Type: "delete_application",
+			ApplicationName: name,
+			Id:uuid.NewV4().String(),
+		})
+	}
+
+	return ret
+}
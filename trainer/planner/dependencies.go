@@ -0,0 +1,77 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+func healthyOn(configurationStore configuration.ConfigurationStore, host *model.Host, name string) bool {
+	application, err := configurationStore.GetConfiguration(name)
+	if err != nil || host.State != state.HOST_RUNNING {
+		return false
+	}
+	for _, running := range host.Apps {
+		if running.Name == name && running.IsHealthy(application.Config[running.Version]) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Every cluster wide dependency has a healthy instance somewhere */
+func clusterDependenciesReady(configurationStore configuration.ConfigurationStore, currentState state.StateStore, application *model.ApplicationConfiguration) bool {
+	for _, dependency := range application.Dependencies {
+		if dependency.Scope == model.DEPENDENCY_HOST {
+			continue
+		}
+		ready := false
+		for _, host := range currentState.GetAllHosts() {
+			if healthyOn(configurationStore, host, dependency.Application) {
+				ready = true
+				break
+			}
+		}
+		if !ready {
+			return false
+		}
+	}
+	return true
+}
+
+/* Every host dependency is healthy on the host */
+func hostDependenciesReady(configurationStore configuration.ConfigurationStore, host *model.Host, application *model.ApplicationConfiguration) bool {
+	for _, dependency := range application.Dependencies {
+		if dependency.Scope == model.DEPENDENCY_HOST && !healthyOn(configurationStore, host, dependency.Application) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasHostDependencies(application *model.ApplicationConfiguration) bool {
+	for _, dependency := range application.Dependencies {
+		if dependency.Scope == model.DEPENDENCY_HOST {
+			return true
+		}
+	}
+	return false
+}
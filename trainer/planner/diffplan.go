@@ -26,7 +26,7 @@ import (
 type DiffPlan struct {
 }
 
-func (*DiffPlan) Init() {
+func (*DiffPlan) Init(parameters map[string]string) {
 
 }
 
@@ -25,7 +25,7 @@ import (
 
 type PlanningChange struct {
 	Id string
-	Type string /* Create Server, Add/Remove Application */
+	Type string /* Create Server, Add/Remove Application, Delete Application (once decommissioned) */
 
 	/* Creation or removal of application */
 	HostId string
@@ -39,7 +39,8 @@ type PlanningChange struct {
 }
 
 type Planner interface {
-	Init()
+	/* Parameters come from the planner section of the trainer settings */
+	Init(parameters map[string]string)
 
 	Plan (configurationStore configuration.ConfigurationStore, currentState state.StateStore) ([]PlanningChange)
 }
@@ -0,0 +1,156 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"strconv"
+	"gatoor/orca/trainer/configuration"
+	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/state"
+)
+
+/* Applications added to a host earlier in the same planning run, by host id. The host only reports them once it
+   applied the changes, until then they are placed with their latest version */
+type reservations map[string][]string
+
+func (reserved reservations) add(hostId string, name string) {
+	reserved[hostId] = append(reserved[hostId], name)
+}
+
+/* Host ports taken on the host and by which application, including the ones reserved in this run. Other versions of
+   the application itself don't count, a new version replaces them. By number, "08080" is the same port as "8080" */
+func usedHostPorts(configurationStore configuration.ConfigurationStore, host *model.Host, except string, reserved reservations) map[int]string {
+	used := make(map[int]string)
+	for _, application := range host.Apps {
+		if application.Name == except {
+			continue
+		}
+		config, err := configurationStore.GetConfiguration(application.Name)
+		if err != nil {
+			continue
+		}
+		for _, mapping := range config.Config[application.Version].PortMappings {
+			used[hostPort(mapping)] = application.Name
+		}
+	}
+	for _, name := range reserved[host.Id] {
+		if name == except {
+			continue
+		}
+		for _, mapping := range latestConfig(configurationStore, name).PortMappings {
+			used[hostPort(mapping)] = name
+		}
+	}
+	return used
+}
+
+/* Host ports are exclusive, an application can't go to a host where another one already uses one of its host ports */
+func hostPortsFree(used map[int]string, config model.VersionConfig) bool {
+	for _, mapping := range config.PortMappings {
+		if _, taken := used[hostPort(mapping)]; taken {
+			return false
+		}
+	}
+	return true
+}
+
+/* Validation only lets numeric ports through */
+func hostPort(mapping model.PortMapping) int {
+	port, _ := strconv.Atoi(mapping.HostPort)
+	return port
+}
+
+/* Names of the applications on the host in any version, and the ones reserved for it in this run */
+func hostApplications(host *model.Host, reserved reservations) []string {
+	names := []string{}
+	for _, application := range host.Apps {
+		names = append(names, application.Name)
+	}
+	return append(names, reserved[host.Id]...)
+}
+
+func contains(names []string, name string) bool {
+	for _, other := range names {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* The labels, affinity, anti-affinity and host dependencies of the application, and the anti-affinity of the applications
+   already on the host or reserved for it in this run. Affinity only counts applications that are on the host */
+func placementAllows(configurationStore configuration.ConfigurationStore, host *model.Host, name string, application *model.ApplicationConfiguration, reserved reservations) bool {
+	labels := host.GetLabels()
+	for key, value := range application.Placement.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	for _, other := range application.Placement.Affinity {
+		if !host.HasAnyVersionOfApp(other) {
+			return false
+		}
+	}
+	present := hostApplications(host, reserved)
+	for _, other := range application.Placement.AntiAffinity {
+		if contains(present, other) {
+			return false
+		}
+	}
+	if !hostDependenciesReady(configurationStore, host, application) {
+		return false
+	}
+	for _, other := range present {
+		otherConfiguration, err := configurationStore.GetConfiguration(other)
+		if err != nil {
+			continue
+		}
+		if contains(otherConfiguration.Placement.AntiAffinity, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func canPlace(configurationStore configuration.ConfigurationStore, host *model.Host, name string, application *model.ApplicationConfiguration, config model.VersionConfig, reserved reservations) bool {
+	return hostPortsFree(usedHostPorts(configurationStore, host, name, reserved), config) && placementAllows(configurationStore, host, name, application, reserved)
+}
+
+/* A new server has no operator labels and runs nothing, starting one for an application that needs either would never end */
+func newServerCouldHost(application *model.ApplicationConfiguration) bool {
+	return len(application.Placement.Labels) == 0 && len(application.Placement.Affinity) == 0 && !hasHostDependencies(application)
+}
+
+/* The candidate in the zone with the fewest instances of the application, hosts without a zone count as one zone */
+func leastUsedZone(currentState state.StateStore, name string, candidates []*model.Host) *model.Host {
+	instances := make(map[string]int)
+	for _, host := range currentState.GetAllHosts() {
+		if host.State != state.HOST_TERMINATING && host.HasAnyVersionOfApp(name) {
+			instances[host.GetLabels()[model.LABEL_ZONE]]++
+		}
+	}
+	chosen := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if instances[candidate.GetLabels()[model.LABEL_ZONE]] < instances[chosen.GetLabels()[model.LABEL_ZONE]] {
+			chosen = candidate
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,337 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"gatoor/orca/trainer/model"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+const MASTER_KEY_SIZE = 32
+
+/* Shorter values are refused, they could not be redacted without mangling unrelated words in the messages */
+const MINIMUM_REDACTED_LENGTH = 8
+
+var SecretsLogger = Logger.LoggerWithField(Logger.Logger, "module", "secrets")
+
+var referencePattern = regexp.MustCompile(`\{\{secret:([A-Za-z0-9_.-]+)\}\}`)
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+/* What the api shows of a secret, never the value */
+type SecretInfo struct {
+	Name      string
+	Updated   time.Time
+	UpdatedBy string
+}
+
+type secret struct {
+	SecretInfo
+	value string
+}
+
+/* On disk, the name is authenticated with the value so entries can't be swapped */
+type encryptedSecret struct {
+	Nonce     []byte
+	Value     []byte
+	Updated   time.Time
+	UpdatedBy string
+}
+
+/* Values referenced as {{secret:name}} in the environment variables and files of a version. They are encrypted
+   with the master key at rest and only put into the changes sent to the host that runs the application */
+type SecretStore struct {
+	lock     sync.RWMutex
+	secrets  map[string]secret
+	file     string
+	aead     cipher.AEAD
+	replacer *strings.Replacer
+}
+
+/* The key comes from the environment (base64) or the key file, which is created on first start.
+   A new key is never created next to existing secrets, they could not be decrypted anymore */
+func LoadMasterKey(keyFile string, encodedKey string, secretsFile string) ([]byte, error) {
+	if encodedKey != "" {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != MASTER_KEY_SIZE {
+			return nil, fmt.Errorf("The master key has to be %d base64 encoded bytes", MASTER_KEY_SIZE)
+		}
+		return key, nil
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != MASTER_KEY_SIZE {
+			return nil, fmt.Errorf("The master key in %s has to be %d base64 encoded bytes", keyFile, MASTER_KEY_SIZE)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if _, err := os.Stat(secretsFile); err == nil {
+		return nil, errors.New("Secrets exist in " + secretsFile + " but the master key " + keyFile + " is missing")
+	}
+
+	SecretsLogger.Infof("No master key found at %s, creating a new one", keyFile)
+	key := make([]byte, MASTER_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key) + "\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (store *SecretStore) Init(file string, masterKey []byte) error {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.aead = aead
+	store.file = file
+	store.secrets = make(map[string]secret)
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		store.updateReplacer()
+		return nil
+	}
+	encrypted := make(map[string]encryptedSecret)
+	if err := json.Unmarshal(content, &encrypted); err != nil {
+		return fmt.Errorf("Could not parse secrets from %s - %s", file, err)
+	}
+	for name, entry := range encrypted {
+		value, err := aead.Open(nil, entry.Nonce, entry.Value, []byte(name))
+		if err != nil {
+			return errors.New("Could not decrypt secret " + name + ", the master key does not match")
+		}
+		store.secrets[name] = secret{SecretInfo: SecretInfo{Name: name, Updated: entry.Updated, UpdatedBy: entry.UpdatedBy}, value: string(value)}
+	}
+	store.updateReplacer()
+	SecretsLogger.Infof("Loaded %d secrets from %s", len(store.secrets), file)
+	return nil
+}
+
+func (store *SecretStore) List() []SecretInfo {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	infos := []SecretInfo{}
+	for _, entry := range store.secrets {
+		infos = append(infos, entry.SecretInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (store *SecretStore) Get(name string) (SecretInfo, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	entry, ok := store.secrets[name]
+	return entry.SecretInfo, ok
+}
+
+func (store *SecretStore) Set(name string, value string, actor string) (SecretInfo, error) {
+	if !namePattern.MatchString(name) {
+		return SecretInfo{}, errors.New("Secret names may only contain letters, digits, '_', '.' and '-'")
+	}
+	if value == "" {
+		return SecretInfo{}, errors.New("Secret " + name + " has no value")
+	}
+	if len(value) < MINIMUM_REDACTED_LENGTH {
+		return SecretInfo{}, errors.New("Secret " + name + " has to be at least " + strconv.Itoa(MINIMUM_REDACTED_LENGTH) + " characters long")
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	info := SecretInfo{Name: name, Updated: time.Now(), UpdatedBy: actor}
+	previous, existed := store.secrets[name]
+	store.secrets[name] = secret{SecretInfo: info, value: value}
+	if err := store.save(); err != nil {
+		if existed {
+			store.secrets[name] = previous
+		} else {
+			delete(store.secrets, name)
+		}
+		return SecretInfo{}, err
+	}
+	store.updateReplacer()
+	return info, nil
+}
+
+func (store *SecretStore) Delete(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	previous, ok := store.secrets[name]
+	if !ok {
+		return errors.New("Could not find secret " + name)
+	}
+	delete(store.secrets, name)
+	if err := store.save(); err != nil {
+		store.secrets[name] = previous
+		return err
+	}
+	store.updateReplacer()
+	return nil
+}
+
+/* Every value gets a fresh nonce, written to a temporary file first so a crash doesn't lose all secrets */
+func (store *SecretStore) save() error {
+	encrypted := make(map[string]encryptedSecret)
+	for name, entry := range store.secrets {
+		nonce := make([]byte, store.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		encrypted[name] = encryptedSecret{
+			Nonce: nonce,
+			Value: store.aead.Seal(nil, nonce, []byte(entry.value), []byte(name)),
+			Updated: entry.Updated,
+			UpdatedBy: entry.UpdatedBy,
+		}
+	}
+	content, err := json.MarshalIndent(encrypted, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := store.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, store.file)
+}
+
+/* Replaces the values in audit and event details, also as they appear escaped in json and base64 encoded for files,
+   with the reference. Api responses never contain the values, only the references. Short values from before they were
+   refused are replaced as well, a mangled message is better than a leaked secret */
+func (store *SecretStore) updateReplacer() {
+	pairs := []string{}
+	for name, entry := range store.secrets {
+		reference := Reference(name)
+		pairs = append(pairs, entry.value, reference, base64.StdEncoding.EncodeToString([]byte(entry.value)), reference)
+		if escaped, err := json.Marshal(entry.value); err == nil {
+			pairs = append(pairs, string(escaped[1:len(escaped) - 1]), reference)
+		}
+	}
+	store.replacer = strings.NewReplacer(pairs...)
+}
+
+func (store *SecretStore) Redact(text string) string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if store.replacer == nil {
+		return text
+	}
+	return store.replacer.Replace(text)
+}
+
+/* A copy of the config with the references replaced by the values. File contents are base64 encoded,
+   a file whose Base64FileContents contains references gets the encoded result */
+func (store *SecretStore) Materialize(config model.VersionConfig) (model.VersionConfig, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var missing []string
+	resolve := func(text string) string {
+		return referencePattern.ReplaceAllStringFunc(text, func(reference string) string {
+			name := referencePattern.FindStringSubmatch(reference)[1]
+			entry, ok := store.secrets[name]
+			if !ok {
+				missing = append(missing, name)
+				return reference
+			}
+			return entry.value
+		})
+	}
+
+	environment := make([]model.EnvironmentVariable, len(config.EnvironmentVariables))
+	for i, variable := range config.EnvironmentVariables {
+		environment[i] = model.EnvironmentVariable{Key: variable.Key, Value: resolve(variable.Value)}
+	}
+	files := make([]model.File, len(config.Files))
+	for i, file := range config.Files {
+		files[i] = file
+		if referencePattern.MatchString(file.Base64FileContents) {
+			files[i].Base64FileContents = base64.StdEncoding.EncodeToString([]byte(resolve(file.Base64FileContents)))
+		}
+	}
+
+	if len(missing) > 0 {
+		return config, errors.New("Unknown secrets " + strings.Join(missing, ", ") + " referenced by version " + config.Version)
+	}
+	config.EnvironmentVariables = environment
+	config.Files = files
+	return config, nil
+}
+
+func Reference(name string) string {
+	return "{{secret:" + name + "}}"
+}
+
+/* Names of the secrets referenced by the environment variables and files of a version */
+func References(config model.VersionConfig) []string {
+	names := []string{}
+	for _, variable := range config.EnvironmentVariables {
+		names = append(names, ReferencesIn(variable.Value)...)
+	}
+	for _, file := range config.Files {
+		names = append(names, ReferencesIn(file.Base64FileContents)...)
+	}
+	return names
+}
+
+func ReferencesIn(text string) []string {
+	names := []string{}
+	for _, match := range referencePattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
@@ -0,0 +1,297 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"gatoor/orca/trainer/model"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "orca-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func key(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, MASTER_KEY_SIZE)
+}
+
+func testStore(t *testing.T, file string, secrets map[string]string) *SecretStore {
+	store := &SecretStore{}
+	if err := store.Init(file, key(1)); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range secrets {
+		if _, err := store.Set(name, value, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	encoded := base64.StdEncoding.EncodeToString(key(7))
+
+	ioutil.WriteFile(filepath.Join(dir, "valid.key"), []byte(encoded + "\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "short.key"), []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "existing.secrets"), []byte("{}"), 0600)
+
+	tests := []struct {
+		name        string
+		keyFile     string
+		encodedKey  string
+		secretsFile string
+		key         []byte
+		fails       bool
+	}{
+		{"from the environment", "missing.key", encoded, "missing.secrets", key(7), false},
+		{"invalid in the environment", "valid.key", "not base64", "missing.secrets", nil, true},
+		{"from the key file", "valid.key", "", "existing.secrets", key(7), false},
+		{"short key file", "short.key", "", "missing.secrets", nil, true},
+		{"missing next to secrets", "missing.key", "", "existing.secrets", nil, true},
+	}
+	for _, test := range tests {
+		loaded, err := LoadMasterKey(filepath.Join(dir, test.keyFile), test.encodedKey, filepath.Join(dir, test.secretsFile))
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !test.fails && !bytes.Equal(loaded, test.key) {
+			t.Errorf("%s: loaded the wrong key", test.name)
+		}
+	}
+}
+
+func TestLoadMasterKeyCreatesKeyFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "master.key")
+
+	created, err := LoadMasterKey(keyFile, "", filepath.Join(dir, "secrets.json"))
+	if err != nil || len(created) != MASTER_KEY_SIZE {
+		t.Fatalf("expected a new key, got %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key file with mode 0600, got %v", err)
+	}
+	loaded, err := LoadMasterKey(keyFile, "", filepath.Join(dir, "secrets.json"))
+	if err != nil || !bytes.Equal(created, loaded) {
+		t.Errorf("expected the created key to be loaded again, got %v", err)
+	}
+}
+
+func TestSecretsRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secrets.json")
+	testStore(t, file, map[string]string{"db.password": "correct horse", "api_token": "abcdefgh12345678"})
+
+	content, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(content), "correct horse") || strings.Contains(string(content), "abcdefgh12345678") {
+		t.Fatal("expected the values to be encrypted at rest")
+	}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		fails bool
+	}{
+		{"same key", key(1), false},
+		{"other key", key(2), true},
+	}
+	for _, test := range tests {
+		store := &SecretStore{}
+		err := store.Init(file, test.key)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		config, err := store.Materialize(model.VersionConfig{EnvironmentVariables: []model.EnvironmentVariable{{Key: "PASSWORD", Value: "{{secret:db.password}}"}}})
+		if err != nil || config.EnvironmentVariables[0].Value != "correct horse" {
+			t.Errorf("%s: expected the decrypted value, got %v %v", test.name, config.EnvironmentVariables, err)
+		}
+		if info, ok := store.Get("api_token"); !ok || info.UpdatedBy != "test" {
+			t.Errorf("%s: expected the metadata to be kept, got %v", test.name, info)
+		}
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := testStore(t, filepath.Join(dir, "secrets.json"), map[string]string{"b": "value of b", "a": "value of a"})
+
+	tests := []struct {
+		name  string
+		value string
+		fails bool
+	}{
+		{"valid-name_1.0", "12345678", false},
+		{"no spaces", "12345678", true},
+		{"slash/name", "12345678", true},
+		{"empty", "", true},
+		{"short", "1234567", true},
+	}
+	for _, test := range tests {
+		if _, err := store.Set(test.name, test.value, "test"); (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+
+	if err := store.Delete("valid-name_1.0"); err != nil {
+		t.Error(err)
+	}
+	if err := store.Delete("unknown"); err == nil {
+		t.Error("expected deleting an unknown secret to fail")
+	}
+	names := []string{}
+	for _, info := range store.List() {
+		names = append(names, info.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("expected the sorted names [a b], got %v", names)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := testStore(t, filepath.Join(dir, "secrets.json"), map[string]string{"user": "administrator", "password": "s3cret-passw0rd"})
+	encoded := base64.StdEncoding.EncodeToString([]byte("plain file"))
+
+	tests := []struct {
+		name        string
+		environment []model.EnvironmentVariable
+		files       []model.File
+		expected    model.VersionConfig
+		fails       bool
+	}{
+		{"no references",
+			[]model.EnvironmentVariable{{Key: "MODE", Value: "production"}},
+			[]model.File{{HostPath: "/etc/plain", Base64FileContents: encoded}},
+			model.VersionConfig{
+				EnvironmentVariables: []model.EnvironmentVariable{{Key: "MODE", Value: "production"}},
+				Files: []model.File{{HostPath: "/etc/plain", Base64FileContents: encoded}},
+			}, false},
+		{"environment variables",
+			[]model.EnvironmentVariable{{Key: "DSN", Value: "{{secret:user}}:{{secret:password}}@db"}},
+			[]model.File{},
+			model.VersionConfig{
+				EnvironmentVariables: []model.EnvironmentVariable{{Key: "DSN", Value: "administrator:s3cret-passw0rd@db"}},
+				Files: []model.File{},
+			}, false},
+		{"files",
+			[]model.EnvironmentVariable{},
+			[]model.File{{HostPath: "/etc/db.conf", Base64FileContents: "password={{secret:password}}"}},
+			model.VersionConfig{
+				EnvironmentVariables: []model.EnvironmentVariable{},
+				Files: []model.File{{HostPath: "/etc/db.conf", Base64FileContents: base64.StdEncoding.EncodeToString([]byte("password=s3cret-passw0rd"))}},
+			}, false},
+		{"unknown secret",
+			[]model.EnvironmentVariable{{Key: "TOKEN", Value: "{{secret:token}}"}},
+			[]model.File{},
+			model.VersionConfig{}, true},
+	}
+	for _, test := range tests {
+		config := model.VersionConfig{Version: "1", EnvironmentVariables: test.environment, Files: test.files}
+		materialized, err := store.Materialize(config)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.fails {
+			if !reflect.DeepEqual(materialized, config) {
+				t.Errorf("%s: expected the config to be returned unchanged", test.name)
+			}
+			continue
+		}
+		test.expected.Version = "1"
+		if !reflect.DeepEqual(materialized, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, materialized)
+		}
+		if !reflect.DeepEqual(config.EnvironmentVariables, test.environment) {
+			t.Errorf("%s: the original config was modified", test.name)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	tests := []struct {
+		text  string
+		names []string
+	}{
+		{"plain", []string{}},
+		{"{{secret:a}}", []string{"a"}},
+		{"{{secret:a}}-{{secret:b.c}}", []string{"a", "b.c"}},
+		{"{{secret:}} {{secret:with space}} {{ secret:a }}", []string{}},
+	}
+	for _, test := range tests {
+		if names := ReferencesIn(test.text); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: expected %v, got %v", test.text, test.names, names)
+		}
+	}
+
+	config := model.VersionConfig{
+		EnvironmentVariables: []model.EnvironmentVariable{{Key: "A", Value: "{{secret:a}}"}},
+		Files: []model.File{{HostPath: "/b", Base64FileContents: "{{secret:b}}"}},
+	}
+	if names := References(config); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("expected [a b], got %v", names)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := testStore(t, filepath.Join(dir, "secrets.json"), map[string]string{"long": "p\"assword123"})
+	/* Set refuses short values, a secrets file from before still has them */
+	store.secrets["short"] = secret{SecretInfo: SecretInfo{Name: "short"}, value: "abc"}
+	store.updateReplacer()
+
+	tests := []struct {
+		text     string
+		redacted string
+	}{
+		{"login with p\"assword123", "login with {{secret:long}}"},
+		{`{"Value":"p\"assword123"}`, `{"Value":"{{secret:long}}"}`},
+		{base64.StdEncoding.EncodeToString([]byte("p\"assword123")), "{{secret:long}}"},
+		{"abc is too short", "{{secret:short}} is too short"},
+		{"nothing to hide", "nothing to hide"},
+	}
+	for _, test := range tests {
+		if redacted := store.Redact(test.text); redacted != test.redacted {
+			t.Errorf("%s: expected %q, got %q", test.text, test.redacted, redacted)
+		}
+	}
+}
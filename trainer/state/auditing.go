@@ -23,18 +23,25 @@ import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"fmt"
+	"gatoor/orca/trainer/events"
 )
 
 type OrcaDb struct {
 	session *mgo.Session
 	db      *mgo.Database
+	/* Applied to the details before the event goes anywhere, keeps secret values out of the audit log */
+	redact  func(string) string
 }
 
 type AuditEvent struct {
 	Timestamp time.Time
+	/* Who caused the event, an operator, a host (host:<id>) or the trainer itself */
+	Actor     string
 	Details   map[string]string
 }
 
+const ACTOR_TRAINER = "trainer"
+
 var Audit OrcaDb
 
 func (a *OrcaDb) Init(hostname string) {
@@ -51,8 +58,28 @@ func (a *OrcaDb) Close() {
 	a.session.Close()
 }
 
+func (db *OrcaDb) SetRedactor(redact func(string) string) {
+	db.redact = redact
+}
+
 func (db *OrcaDb) Insert__AuditEvent(event AuditEvent) {
-	fmt.Printf("AUDIT: %s\n", event.Details["message"])
+	if event.Actor == "" {
+		event.Actor = ACTOR_TRAINER
+	}
+	if db.redact != nil {
+		redacted := make(map[string]string)
+		for key, value := range event.Details {
+			redacted[key] = db.redact(value)
+		}
+		event.Details = redacted
+	}
+	fmt.Printf("AUDIT: [%s] %s\n", event.Actor, event.Details["message"])
+
+	details := map[string]string{"actor": event.Actor}
+	for key, value := range event.Details {
+		details[key] = value
+	}
+	events.Cluster.Publish(events.Event{Type: events.EVENT_AUDIT, HostId: event.Details["host"], Application: event.Details["application"], Details: details})
 
 	if db.session == nil {
 		return
@@ -67,8 +94,12 @@ func (db *OrcaDb) Insert__AuditEvent(event AuditEvent) {
 }
 
 func (db *OrcaDb) Query__AuditEvents(application string) []AuditEvent {
-	c := db.db.C("audit")
 	var results []AuditEvent
+	if db.session == nil {
+		return results
+	}
+
+	c := db.db.C("audit")
 	if application != "" {
 		err := c.Find(bson.M{"details.application": application}).Sort("-Timestamp").All(&results)
 		if err != nil {
@@ -0,0 +1,321 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"gatoor/orca/trainer/model"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+const (
+	DEFAULT_RAW_SAMPLES = 360
+	DEFAULT_BUCKET_SIZE = time.Minute * 5
+	DEFAULT_BUCKETS     = 288
+)
+
+/* A raw sample from a checkin, or the average of all samples in a bucket when downsampled */
+type MetricSample struct {
+	Time         time.Time
+	CpuUsage     float64
+	MemoryUsage  float64
+	NetworkUsage float64
+	Samples      int
+}
+
+type MetricSeries struct {
+	HostId      string
+	Application string
+	Samples     []MetricSample
+}
+
+type sampleRing struct {
+	Samples []MetricSample
+	Start   int
+	Count   int
+}
+
+func newSampleRing(capacity int) sampleRing {
+	return sampleRing{Samples: make([]MetricSample, capacity)}
+}
+
+func (ring *sampleRing) push(sample MetricSample) {
+	capacity := len(ring.Samples)
+	if capacity == 0 {
+		return
+	}
+	if ring.Count < capacity {
+		ring.Samples[(ring.Start + ring.Count) % capacity] = sample
+		ring.Count++
+		return
+	}
+	ring.Samples[ring.Start] = sample
+	ring.Start = (ring.Start + 1) % capacity
+}
+
+/* Oldest first */
+func (ring *sampleRing) all() []MetricSample {
+	ordered := make([]MetricSample, 0, ring.Count)
+	for i := 0; i < ring.Count; i++ {
+		ordered = append(ordered, ring.Samples[(ring.Start + i) % len(ring.Samples)])
+	}
+	return ordered
+}
+
+/* Recent checkins are kept as they are, older ones only as averages per bucket */
+type metricSeries struct {
+	Raw          sampleRing
+	Downsampled  sampleRing
+	Bucket       MetricSample
+}
+
+func (series *metricSeries) add(sample MetricSample, bucketSize time.Duration) {
+	series.Raw.push(sample)
+
+	bucketStart := sample.Time.Truncate(bucketSize)
+	if series.Bucket.Samples > 0 && !series.Bucket.Time.Equal(bucketStart) {
+		series.Downsampled.push(series.Bucket.average())
+		series.Bucket = MetricSample{}
+	}
+	series.Bucket.Time = bucketStart
+	series.Bucket.CpuUsage += sample.CpuUsage
+	series.Bucket.MemoryUsage += sample.MemoryUsage
+	series.Bucket.NetworkUsage += sample.NetworkUsage
+	series.Bucket.Samples++
+}
+
+func (bucket MetricSample) average() MetricSample {
+	if bucket.Samples == 0 {
+		return bucket
+	}
+	return MetricSample{
+		Time: bucket.Time,
+		CpuUsage: bucket.CpuUsage / float64(bucket.Samples),
+		MemoryUsage: bucket.MemoryUsage / float64(bucket.Samples),
+		NetworkUsage: bucket.NetworkUsage / float64(bucket.Samples),
+		Samples: bucket.Samples,
+	}
+}
+
+/* Downsampled buckets up to where the raw samples start, then the raw samples */
+func (series *metricSeries) between(from time.Time, to time.Time) []MetricSample {
+	raw := series.Raw.all()
+	rawStart := to.Add(time.Nanosecond)
+	if len(raw) > 0 {
+		rawStart = raw[0].Time
+	}
+
+	samples := []MetricSample{}
+	for _, bucket := range series.Downsampled.all() {
+		if bucket.Time.Before(rawStart) && !bucket.Time.Before(from) && !bucket.Time.After(to) {
+			samples = append(samples, bucket)
+		}
+	}
+	for _, sample := range raw {
+		if !sample.Time.Before(from) && !sample.Time.After(to) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func (series *metricSeries) latest() time.Time {
+	if series.Raw.Count == 0 {
+		return time.Time{}
+	}
+	return series.Raw.Samples[(series.Raw.Start + series.Raw.Count - 1) % len(series.Raw.Samples)].Time
+}
+
+type seriesKey struct {
+	HostId      string
+	Application string
+}
+
+/* Bounded history of the metrics the hosts send with their checkins, per host and application */
+type MetricsHistory struct {
+	lock           sync.RWMutex
+	series         map[seriesKey]*metricSeries
+	rawSamples     int
+	bucketSize     time.Duration
+	buckets        int
+	persistFile    string
+}
+
+type persistedSeries struct {
+	HostId      string
+	Application string
+	Series      *metricSeries
+}
+
+func (history *MetricsHistory) Init(rawSamples int, bucketSize time.Duration, buckets int, persistFile string) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	history.series = make(map[seriesKey]*metricSeries)
+	history.rawSamples = rawSamples
+	history.bucketSize = bucketSize
+	history.buckets = buckets
+	history.persistFile = persistFile
+
+	if persistFile != "" {
+		history.load()
+	}
+}
+
+func (history *MetricsHistory) Record(hostId string, metrics map[string]model.Metric) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	now := time.Now()
+	for application, metric := range metrics {
+		key := seriesKey{hostId, application}
+		series, ok := history.series[key]
+		if !ok {
+			series = &metricSeries{Raw: newSampleRing(history.rawSamples), Downsampled: newSampleRing(history.buckets)}
+			history.series[key] = series
+		}
+		series.add(MetricSample{
+			Time: now,
+			CpuUsage: float64(metric.CpuUsage),
+			MemoryUsage: float64(metric.MemoryUsage),
+			NetworkUsage: float64(metric.NetworkUsage),
+			Samples: 1,
+		}, history.bucketSize)
+	}
+}
+
+/* An empty host or application matches all of them */
+func (history *MetricsHistory) Query(hostId string, application string, from time.Time, to time.Time) []MetricSeries {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+
+	result := []MetricSeries{}
+	for key, series := range history.series {
+		if (hostId != "" && key.HostId != hostId) || (application != "" && key.Application != application) {
+			continue
+		}
+		samples := series.between(from, to)
+		if len(samples) > 0 {
+			result = append(result, MetricSeries{HostId: key.HostId, Application: key.Application, Samples: samples})
+		}
+	}
+	return result
+}
+
+/* Average of all instances of an application over the last period, false if there are no samples */
+func (history *MetricsHistory) ApplicationAverage(application string, period time.Duration) (MetricSample, bool) {
+	to := time.Now()
+	total := MetricSample{Time: to}
+	for _, series := range history.Query("", application, to.Add(-period), to) {
+		for _, sample := range series.Samples {
+			total.CpuUsage += sample.CpuUsage
+			total.MemoryUsage += sample.MemoryUsage
+			total.NetworkUsage += sample.NetworkUsage
+			total.Samples++
+		}
+	}
+	if total.Samples == 0 {
+		return total, false
+	}
+	average := total.average()
+	average.Samples = total.Samples
+	return average, true
+}
+
+/* Drops series that have not been updated for longer than the retention, e.g. removed hosts */
+func (history *MetricsHistory) Prune() {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	retention := history.bucketSize * time.Duration(history.buckets)
+	for key, series := range history.series {
+		if time.Since(series.latest()) > retention {
+			delete(history.series, key)
+		}
+	}
+}
+
+func (history *MetricsHistory) Save() error {
+	if history.persistFile == "" {
+		return nil
+	}
+	history.lock.RLock()
+	persisted := []persistedSeries{}
+	for key, series := range history.series {
+		persisted = append(persisted, persistedSeries{HostId: key.HostId, Application: key.Application, Series: series})
+	}
+	content, err := json.Marshal(persisted)
+	history.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFile := history.persistFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, history.persistFile)
+}
+
+/* Series with a different ring size than configured are dropped, they would not fit */
+func (history *MetricsHistory) load() {
+	content, err := ioutil.ReadFile(history.persistFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.InitLogger.Errorf("Could not read metrics history from %s - %s", history.persistFile, err)
+		}
+		return
+	}
+	persisted := []persistedSeries{}
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		Logger.InitLogger.Errorf("Could not parse metrics history from %s - %s", history.persistFile, err)
+		return
+	}
+	for _, entry := range persisted {
+		if entry.Series == nil || len(entry.Series.Raw.Samples) != history.rawSamples || len(entry.Series.Downsampled.Samples) != history.buckets {
+			continue
+		}
+		history.series[seriesKey{entry.HostId, entry.Application}] = entry.Series
+	}
+	Logger.InitLogger.Infof("Loaded %d metric series from %s", len(history.series), history.persistFile)
+}
+
+/* Prunes the history every interval, with or without persistence, runs until the trainer stops */
+func (history *MetricsHistory) PruneEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			history.Prune()
+		}
+	}()
+}
+
+/* Saves the history every interval, runs until the trainer stops */
+func (history *MetricsHistory) PersistEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := history.Save(); err != nil {
+				Logger.Logger.Errorf("Could not save metrics history - %s", err)
+			}
+		}
+	}()
+}
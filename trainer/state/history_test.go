@@ -0,0 +1,197 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var historyStart = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+/* A sample every minute from the start, the cpu usage is the minute */
+func minutes(values ...int) []MetricSample {
+	samples := []MetricSample{}
+	for _, minute := range values {
+		samples = append(samples, MetricSample{Time: historyStart.Add(time.Duration(minute) * time.Minute), CpuUsage: float64(minute), Samples: 1})
+	}
+	return samples
+}
+
+func TestSampleRing(t *testing.T) {
+	tests := []struct {
+		capacity int
+		pushed   []int
+		kept     []int
+	}{
+		{3, []int{}, []int{}},
+		{3, []int{1, 2}, []int{1, 2}},
+		{3, []int{1, 2, 3}, []int{1, 2, 3}},
+		{3, []int{1, 2, 3, 4}, []int{2, 3, 4}},
+		{3, []int{1, 2, 3, 4, 5, 6, 7}, []int{5, 6, 7}},
+		{0, []int{1, 2}, []int{}},
+	}
+	for _, test := range tests {
+		ring := newSampleRing(test.capacity)
+		for _, sample := range minutes(test.pushed...) {
+			ring.push(sample)
+		}
+		if all := ring.all(); !reflect.DeepEqual(all, minutes(test.kept...)) {
+			t.Errorf("%v in %d: expected %v, got %v", test.pushed, test.capacity, minutes(test.kept...), all)
+		}
+	}
+}
+
+func TestMetricSeriesDownsampling(t *testing.T) {
+	bucket := func(minute int, cpu float64, samples int) MetricSample {
+		return MetricSample{Time: historyStart.Add(time.Duration(minute) * time.Minute), CpuUsage: cpu, Samples: samples}
+	}
+	tests := []struct {
+		name        string
+		added       []int
+		downsampled []MetricSample
+		current     MetricSample
+	}{
+		{"first bucket open", []int{0, 1, 2}, []MetricSample{}, bucket(0, 3, 3)},
+		{"bucket closed by the next one", []int{0, 1, 2, 3, 4, 5}, []MetricSample{bucket(0, 2, 5)}, bucket(5, 5, 1)},
+		{"gaps", []int{1, 3, 12, 26}, []MetricSample{bucket(0, 2, 2), bucket(10, 12, 1)}, bucket(25, 26, 1)},
+		{"oldest buckets dropped", []int{0, 5, 10, 15, 20}, []MetricSample{bucket(5, 5, 1), bucket(10, 10, 1), bucket(15, 15, 1)}, bucket(20, 20, 1)},
+	}
+	for _, test := range tests {
+		series := metricSeries{Raw: newSampleRing(2), Downsampled: newSampleRing(3)}
+		for _, sample := range minutes(test.added...) {
+			series.add(sample, time.Minute * 5)
+		}
+		if downsampled := series.Downsampled.all(); !reflect.DeepEqual(downsampled, test.downsampled) {
+			t.Errorf("%s: expected the buckets %v, got %v", test.name, test.downsampled, downsampled)
+		}
+		if series.Bucket != test.current {
+			t.Errorf("%s: expected the open bucket %v, got %v", test.name, test.current, series.Bucket)
+		}
+		if raw := series.Raw.all(); !reflect.DeepEqual(raw, minutes(test.added[len(test.added) - 2:]...)) {
+			t.Errorf("%s: expected the last two raw samples, got %v", test.name, raw)
+		}
+	}
+}
+
+func TestMetricSeriesBetween(t *testing.T) {
+	series := metricSeries{Raw: newSampleRing(3), Downsampled: newSampleRing(10)}
+	for _, sample := range minutes(0, 5, 10, 15, 16, 17) {
+		series.add(sample, time.Minute * 5)
+	}
+	cpu := func(samples []MetricSample) []float64 {
+		values := []float64{}
+		for _, sample := range samples {
+			values = append(values, sample.CpuUsage)
+		}
+		return values
+	}
+	tests := []struct {
+		name string
+		from int
+		to   int
+		cpu  []float64
+	}{
+		{"everything", -60, 60, []float64{0, 5, 10, 15, 16, 17}},
+		{"raw samples only", 15, 60, []float64{15, 16, 17}},
+		{"buckets only", 0, 9, []float64{0, 5}},
+		{"bounds included", 5, 16, []float64{5, 10, 15, 16}},
+		{"before the history", -60, -1, []float64{}},
+	}
+	for _, test := range tests {
+		samples := series.between(historyStart.Add(time.Duration(test.from) * time.Minute), historyStart.Add(time.Duration(test.to) * time.Minute))
+		if values := cpu(samples); !reflect.DeepEqual(values, test.cpu) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.cpu, values)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	history := &MetricsHistory{}
+	history.Init(10, time.Minute, 60, "")
+	tests := []struct {
+		host   string
+		age    time.Duration
+		pruned bool
+	}{
+		{"recent", time.Minute, false},
+		{"within the retention", time.Minute * 59, false},
+		{"removed host", time.Minute * 61, true},
+	}
+	for _, test := range tests {
+		series := &metricSeries{Raw: newSampleRing(10), Downsampled: newSampleRing(60)}
+		series.add(MetricSample{Time: time.Now().Add(-test.age), Samples: 1}, time.Minute)
+		history.series[seriesKey{test.host, "web"}] = series
+	}
+
+	history.Prune()
+	for _, test := range tests {
+		if _, ok := history.series[seriesKey{test.host, "web"}]; ok == test.pruned {
+			t.Errorf("%s: expected pruned to be %t", test.host, test.pruned)
+		}
+	}
+}
+
+func TestHistoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orca-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	history := &MetricsHistory{}
+	history.Init(10, time.Minute, 60, file)
+	series := &metricSeries{Raw: newSampleRing(10), Downsampled: newSampleRing(60)}
+	for _, sample := range minutes(0, 1, 2) {
+		series.add(sample, time.Minute)
+	}
+	history.series[seriesKey{"host1", "web"}] = series
+	if err := history.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rawSamples int
+		buckets    int
+		loaded     int
+	}{
+		{10, 60, 1},
+		{20, 60, 0},
+		{10, 30, 0},
+	}
+	for _, test := range tests {
+		loaded := &MetricsHistory{}
+		loaded.Init(test.rawSamples, time.Minute, test.buckets, file)
+		if len(loaded.series) != test.loaded {
+			t.Errorf("%d raw samples, %d buckets: expected %d series, got %d", test.rawSamples, test.buckets, test.loaded, len(loaded.series))
+			continue
+		}
+		if test.loaded > 0 {
+			samples := loaded.Query("host1", "web", historyStart, historyStart.Add(time.Hour))[0].Samples
+			if len(samples) != 3 || samples[2].CpuUsage != 2 {
+				t.Errorf("expected the saved samples, got %v", samples)
+			}
+		}
+	}
+}
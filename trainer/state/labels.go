@@ -0,0 +1,100 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"gatoor/orca/trainer/events"
+	Logger "gatoor/orca/trainer/logs"
+)
+
+/* The state is rebuilt from the checkins after a restart, the labels the operators set are kept in a file */
+func (store *StateStore) LoadHostLabels(filename string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.hostLabelsFile = filename
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.InitLogger.Errorf("Could not read host labels from %s - %s", filename, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(content, &store.hostLabels); err != nil {
+		Logger.InitLogger.Errorf("Could not parse host labels from %s - %s", filename, err)
+	}
+}
+
+func (store *StateStore) SetLabels(hostId string, labels map[string]string, actor string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return err
+	}
+	host.Labels = labels
+	store.hostLabels[hostId] = labels
+
+	Audit.Insert__AuditEvent(AuditEvent{Actor: actor, Details:map[string]string{
+		"message": "Labels of host " + hostId + " set to " + describeLabels(labels),
+		"host": hostId,
+	}})
+	events.PlanningTrigger.Fire("labels of host " + hostId + " changed")
+	return store.saveHostLabels()
+}
+
+/* Whatever the cloud engine knows about the host, e.g. its zone */
+func (store *StateStore) SetCloudLabels(hostId string, labels map[string]string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return
+	}
+	host.CloudLabels = labels
+	events.PlanningTrigger.Fire("labels of host " + hostId + " discovered")
+}
+
+/* The caller holds the lock */
+func (store *StateStore) saveHostLabels() error {
+	if store.hostLabelsFile == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(store.hostLabels, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.hostLabelsFile, content, 0644)
+}
+
+func describeLabels(labels map[string]string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		pairs = append(pairs, key + "=" + value)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
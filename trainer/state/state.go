@@ -20,31 +20,79 @@ package state
 
 import (
 	"errors"
+	"sync"
 	"time"
 	"gatoor/orca/trainer/model"
+	"gatoor/orca/trainer/events"
+)
+
+const (
+	HOST_RUNNING     = "running"
+	HOST_LOST        = "lost"
+	/* A kill_server was dispatched, the host disappears once it stops checking in */
+	HOST_TERMINATING = "terminating"
 )
 
 type StateStore struct {
 	hosts map[string]*model.Host;
+	History *MetricsHistory
+
+	/* Labels set by the operators by host id, also for hosts that haven't checked in since a restart */
+	hostLabels     map[string]map[string]string
+	hostLabelsFile string
+
+	/* Held for hosts and the labels, checkins, the api, the planner and the timers all change them. A pointer, the
+	   planners get the store by value */
+	lock *sync.RWMutex
 }
 
 func (store *StateStore) Init() {
+	store.lock = &sync.RWMutex{}
 	store.hosts = make(map[string]*model.Host);
+	store.hostLabels = make(map[string]map[string]string)
+	store.History = &MetricsHistory{}
+	store.History.Init(DEFAULT_RAW_SAMPLES, DEFAULT_BUCKET_SIZE, DEFAULT_BUCKETS, "")
 }
 
+/* The host and all hosts are handed out as copies. The store replaces the slices and maps of a host instead of
+   changing them, the copies can be read without holding the lock */
 func (store *StateStore) GetConfiguration(hostId string) (*model.Host, error) {
-	if app, ok := store.hosts[hostId]; ok {
-		return app, nil;
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Could not ");
+	copied := *host
+	return &copied, nil
 }
 
 func (store *StateStore) GetAllHosts() map[string]*model.Host {
-	return store.hosts
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	hosts := make(map[string]*model.Host)
+	for id, host := range store.hosts {
+		copied := *host
+		hosts[id] = &copied
+	}
+	return hosts
+}
+
+/* The caller holds the lock */
+func (store *StateStore) host(hostId string) (*model.Host, error) {
+	if host, ok := store.hosts[hostId]; ok {
+		return host, nil;
+	}
+	return nil, errors.New("Could not find host " + hostId);
 }
 
 func (store *StateStore) GetApplication(hostId string, applicationName string) (model.Application, error) {
-	host, _ := store.GetConfiguration(hostId)
+	host, err := store.GetConfiguration(hostId)
+	if err != nil {
+		return model.Application{}, err
+	}
 	for _, application := range host.Apps {
 		if application.Name == applicationName {
 			return application, nil
@@ -54,37 +102,271 @@ func (store *StateStore) GetApplication(hostId string, applicationName string) (
 }
 
 func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDataPackage) (*model.Host, error) {
-	host, err := store.GetConfiguration(hostId)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	changed := false
+	host, err := store.host(hostId)
 	if err != nil {
+		changed = true
 		host = &model.Host{
-			Id: hostId, LastSeen: "", FirstSeen: time.Now().Format(time.RFC3339Nano), State: "running", Apps: []model.Application{}, Changes: []model.ChangeApplication{}, Resources: model.HostResources{},
+			Id: hostId, LastSeen: "", FirstSeen: time.Now().Format(time.RFC3339Nano), State: HOST_RUNNING, Apps: []model.Application{}, Changes: []model.ChangeApplication{}, Resources: model.HostResources{}, Draining: []model.DrainingApplication{},
+			Labels: store.hostLabels[hostId], CloudLabels: map[string]string{},
 		}
 		store.hosts[hostId] = host
 
-		Audit.Insert__AuditEvent(AuditEvent{Details:map[string]string{
+		Audit.Insert__AuditEvent(AuditEvent{Actor: "host:" + hostId, Details:map[string]string{
 			"message": "Discovered new host " + hostId,
 			"host": hostId,
 		}})
+		events.Cluster.Publish(events.Event{Type: events.EVENT_HOST_DISCOVERED, HostId: hostId, Details: map[string]string{}})
+	} else if host.State == HOST_LOST {
+		changed = true
+		host.State = HOST_RUNNING
+		Audit.Insert__AuditEvent(AuditEvent{Actor: "host:" + hostId, Details:map[string]string{
+			"message": "Lost host " + hostId + " is back",
+			"host": hostId,
+		}})
+		events.Cluster.Publish(events.Event{Type: events.EVENT_HOST_DISCOVERED, HostId: hostId, Details: map[string]string{"recovered": "true"}})
 	}
 
-	for change, contains := range checkin.ChangesApplied {
-		if contains {
-			store.RemoveChange(host.Id, change)
+	for changeId, contains := range checkin.ChangesApplied {
+		if !contains {
+			continue
+		}
+		for _, change := range host.Changes {
+			if change.Id == changeId {
+				events.PublishChange(host.Id, change.Name, change.Id, change.Type, events.CHANGE_APPLIED)
+				store.removeChange(host, changeId)
+				changed = true
+				break
+			}
 		}
 	}
 
 	host.LastSeen = time.Now().Format(time.RFC3339Nano)
+	host.Metrics = checkin.Metrics
+	if checkin.Ip != "" {
+		host.Ip = checkin.Ip
+	}
+	if checkin.Resources != (model.HostResources{}) {
+		host.Resources = checkin.Resources
+	}
+	store.History.Record(hostId, checkin.Metrics)
+	previousApps := host.Apps
 	host.Apps = make([]model.Application, 0)
 	for _, appStateFromHost := range checkin.State {
-		host.Apps = append(host.Apps, appStateFromHost.Application)
+		application := appStateFromHost.Application
+		application.Started = startedSince(previousApps, application)
+		host.Apps = append(host.Apps, application)
+	}
+
+	publishApplicationTransitions(hostId, previousApps, host.Apps)
+
+	if changed || !sameApplicationStates(previousApps, host.Apps) {
+		events.PlanningTrigger.Fire("checkin of host " + hostId)
+	}
+
+	copied := *host
+	return &copied, nil
+}
+
+/* The start period of the health checks runs from the first checkin that reports the version running */
+func startedSince(previous []model.Application, application model.Application) string {
+	if application.State != "running" {
+		return ""
+	}
+	for _, old := range previous {
+		if old.Name == application.Name && old.Version == application.Version && old.State == "running" && old.Started != "" {
+			return old.Started
+		}
+	}
+	return time.Now().Format(time.RFC3339Nano)
+}
+
+/* Only the fields the planner looks at, metrics change on every checkin */
+func sameApplicationStates(previous []model.Application, current []model.Application) bool {
+	if len(previous) != len(current) {
+		return false
+	}
+	for i := range previous {
+		if previous[i].Name != current[i].Name || previous[i].Version != current[i].Version || previous[i].State != current[i].State || previous[i].Health != current[i].Health {
+			return false
+		}
+	}
+	return true
+}
+
+func publishApplicationTransitions(hostId string, previous []model.Application, current []model.Application) {
+	before := make(map[string]model.Application)
+	for _, application := range previous {
+		before[application.Name] = application
+	}
+
+	for _, application := range current {
+		old, existed := before[application.Name]
+		delete(before, application.Name)
+		if existed && old.State == application.State && old.Version == application.Version && old.Health == application.Health {
+			continue
+		}
+		events.Cluster.Publish(events.Event{
+			Type: events.EVENT_APPLICATION_STATE,
+			HostId: hostId,
+			Application: application.Name,
+			Details: map[string]string{"from": old.State, "to": application.State, "version": application.Version, "health": application.Health},
+		})
+	}
+
+	for name, old := range before {
+		events.Cluster.Publish(events.Event{
+			Type: events.EVENT_APPLICATION_STATE,
+			HostId: hostId,
+			Application: name,
+			Details: map[string]string{"from": old.State, "to": "removed", "version": old.Version},
+		})
+	}
+}
+
+/* Hosts that did not check in for the timeout are marked lost until they show up again,
+   terminated hosts are forgotten */
+func (store *StateStore) CheckLostHosts(timeout time.Duration) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, host := range store.hosts {
+		lastSeen, err := time.Parse(time.RFC3339Nano, host.LastSeen)
+		if err != nil || host.State == HOST_LOST || time.Since(lastSeen) < timeout {
+			continue
+		}
+
+		if host.State == HOST_TERMINATING {
+			delete(store.hosts, host.Id)
+			if _, ok := store.hostLabels[host.Id]; ok {
+				delete(store.hostLabels, host.Id)
+				store.saveHostLabels()
+			}
+			Audit.Insert__AuditEvent(AuditEvent{Details:map[string]string{
+				"message": "Terminated host " + host.Id + " is gone",
+				"host": host.Id,
+			}})
+			events.Cluster.Publish(events.Event{Type: events.EVENT_HOST_LOST, HostId: host.Id, Details: map[string]string{"lastSeen": host.LastSeen, "terminated": "true"}})
+			continue
+		}
+
+		host.State = HOST_LOST
+		Audit.Insert__AuditEvent(AuditEvent{Details:map[string]string{
+			"message": "Lost host " + host.Id + ", last seen " + host.LastSeen,
+			"host": host.Id,
+		}})
+		events.Cluster.Publish(events.Event{Type: events.EVENT_HOST_LOST, HostId: host.Id, Details: map[string]string{"lastSeen": host.LastSeen}})
+		events.PlanningTrigger.Fire("lost host " + host.Id)
 	}
+}
+
+func (store *StateStore) MarkTerminating(hostId string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
 
-	return store.GetConfiguration(hostId)
+	host, err := store.host(hostId)
+	if err != nil {
+		return err
+	}
+	host.State = HOST_TERMINATING
+	return nil
+}
+
+/* The cloud provider failed to terminate the host, it can be used again */
+func (store *StateStore) CancelTermination(hostId string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil || host.State != HOST_TERMINATING {
+		return
+	}
+	host.State = HOST_RUNNING
+	Audit.Insert__AuditEvent(AuditEvent{Details:map[string]string{
+		"message": "Could not terminate host " + hostId + ", keeping it",
+		"host": hostId,
+	}})
+}
+
+func (store *StateStore) AddChange(hostId string, change model.ChangeApplication) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return err
+	}
+	store.addChange(host, change)
+	return nil
+}
+
+/* The caller holds the lock */
+func (store *StateStore) addChange(host *model.Host, change model.ChangeApplication) {
+	host.Changes = append(append([]model.ChangeApplication{}, host.Changes...), change)
+	events.PublishChange(host.Id, change.Name, change.Id, change.Type, events.CHANGE_CREATED)
+}
+
+/* The removal is sent to the host after the period, the load balancers drop the instance in the meantime */
+func (store *StateStore) DrainAndRemove(hostId string, change model.ChangeApplication, period time.Duration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	host.Draining = append(append([]model.DrainingApplication{}, host.Draining...), model.DrainingApplication{
+		Name: change.Name,
+		Since: now.Format(time.RFC3339Nano),
+		Until: now.Add(period).Format(time.RFC3339Nano),
+		Change: change,
+	})
+	events.PublishChange(hostId, change.Name, change.Id, change.Type, events.CHANGE_DRAINING)
+	time.AfterFunc(period, func() {
+		store.finishDraining(hostId, change.Id)
+	})
+	return nil
+}
+
+/* Runs on the timer of DrainAndRemove */
+func (store *StateStore) finishDraining(hostId string, changeId string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return
+	}
+	remaining := []model.DrainingApplication{}
+	var drained *model.DrainingApplication
+	for i, draining := range host.Draining {
+		if draining.Change.Id == changeId {
+			drained = &host.Draining[i]
+		} else {
+			remaining = append(remaining, draining)
+		}
+	}
+	host.Draining = remaining
+	if drained == nil {
+		return
+	}
+
+	/* The change times out from now on, not from when draining started */
+	change := drained.Change
+	change.Time = time.Now().Format(time.RFC3339Nano)
+	store.addChange(host, change)
 }
 
 func (store *StateStore) HasChanges() bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
 	for _, host := range store.hosts {
-		if len(host.Changes) > 0 {
+		if len(host.Changes) > 0 || len(host.Draining) > 0 {
 			return true;
 		}
 	}
@@ -93,7 +375,18 @@ func (store *StateStore) HasChanges() bool {
 }
 
 func (store *StateStore) RemoveChange(hostId string, changeId string) {
-	host, _ := store.GetConfiguration(hostId)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	host, err := store.host(hostId)
+	if err != nil {
+		return
+	}
+	store.removeChange(host, changeId)
+}
+
+/* The caller holds the lock */
+func (store *StateStore) removeChange(host *model.Host, changeId string) {
 	newChanges := make([]model.ChangeApplication, 0)
 	for _, change := range host.Changes {
 		if change.Id != changeId {
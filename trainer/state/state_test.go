@@ -0,0 +1,130 @@
+/*
+Copyright Alex Mack and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"gatoor/orca/trainer/model"
+)
+
+func TestHostsAreCopies(t *testing.T) {
+	store := &StateStore{}
+	store.Init()
+	store.HostCheckin("host1", model.HostCheckinDataPackage{})
+
+	host, err := store.GetConfiguration("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.State = HOST_LOST
+	store.GetAllHosts()["host1"].State = HOST_LOST
+	if host, _ := store.GetConfiguration("host1"); host.State != HOST_RUNNING {
+		t.Errorf("expected the host in the store to stay %s, got %s", HOST_RUNNING, host.State)
+	}
+	if _, err := store.GetConfiguration("host2"); err == nil {
+		t.Error("expected an unknown host to be an error")
+	}
+}
+
+/* Checkins come from the api, lost hosts are checked by the planner loop */
+func TestConcurrentCheckinsAndLostHosts(t *testing.T) {
+	store := &StateStore{}
+	store.Init()
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := 0; i < 200; i++ {
+				hostId := "host" + strconv.Itoa(worker) + "-" + strconv.Itoa(i % 20)
+				store.HostCheckin(hostId, model.HostCheckinDataPackage{})
+				store.MarkTerminating(hostId)
+			}
+		}(worker)
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 200; i++ {
+			store.CheckLostHosts(0)
+			store.HasChanges()
+			store.GetAllHosts()
+		}
+	}()
+	wait.Wait()
+}
+
+func TestDrainAndRemove(t *testing.T) {
+	store := &StateStore{}
+	store.Init()
+	store.HostCheckin("host1", model.HostCheckinDataPackage{})
+
+	change := model.ChangeApplication{Id: "change1", Type: "remove_application", Name: "web"}
+	if err := store.DrainAndRemove("host2", change, time.Millisecond); err == nil {
+		t.Error("expected draining on an unknown host to fail")
+	}
+	if err := store.DrainAndRemove("host1", change, time.Millisecond * 20); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := store.GetConfiguration("host1")
+	if !host.IsDraining("web") || len(host.Changes) != 0 || !store.HasChanges() {
+		t.Fatalf("expected the removal to wait while draining, got %v %v", host.Draining, host.Changes)
+	}
+
+	/* Checkins keep coming in while the timer fires */
+	for i := 0; i < 50; i++ {
+		store.HostCheckin("host1", model.HostCheckinDataPackage{})
+		time.Sleep(time.Millisecond)
+	}
+	host, _ = store.GetConfiguration("host1")
+	if host.IsDraining("web") || len(host.Changes) != 1 || host.Changes[0].Id != "change1" || host.Changes[0].Time == "" {
+		t.Errorf("expected the removal to be sent after draining, got %v %v", host.Draining, host.Changes)
+	}
+}
+
+/* The cloud labels arrive on their own goroutine while the host checks in */
+func TestSetCloudLabels(t *testing.T) {
+	store := &StateStore{}
+	store.Init()
+	store.HostCheckin("host1", model.HostCheckinDataPackage{})
+	store.SetLabels("host1", map[string]string{"zone": "operator"}, "test")
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		store.SetCloudLabels("host1", map[string]string{"zone": "cloud", "type": "t2.micro"})
+		store.SetCloudLabels("host2", map[string]string{"zone": "cloud"})
+	}()
+	for i := 0; i < 20; i++ {
+		store.HostCheckin("host1", model.HostCheckinDataPackage{})
+	}
+	wait.Wait()
+
+	host, _ := store.GetConfiguration("host1")
+	if labels := host.GetLabels(); labels["zone"] != "operator" || labels["type"] != "t2.micro" {
+		t.Errorf("expected the operator labels to win over the cloud labels, got %v", labels)
+	}
+	if _, err := store.GetConfiguration("host2"); err == nil {
+		t.Error("expected labels of an unknown host not to create it")
+	}
+}
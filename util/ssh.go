@@ -20,6 +20,7 @@ package util
 
 import (
 ssh "golang.org/x/crypto/ssh"
+"bytes"
 "fmt"
 log "gatoor/orca/util/log"
 "github.com/Sirupsen/logrus"
@@ -127,3 +128,25 @@ func ExecuteSshCommand(conn *ssh.Client, addr string, cmd string) bool {
 	}
 	return false
 }
+
+/* Writes the content to a file only the ssh user can read. The content goes through stdin, it doesn't show up in the
+   process list of the host or in the logs like the commands do */
+func WriteSshFile(conn *ssh.Client, addr string, path string, content []byte) bool {
+	var SSHLogger = log.LoggerWithField(log.LoggerWithField(log.AuditLogger, "Type", "ssh"), "target", addr)
+	SSHLogger.Info(fmt.Sprintf("Writing file: [%s]", path))
+	for i := 1; i <= EXECUTE_RETRY_AMOUNT; i++ {
+		session, err := conn.NewSession()
+		if err == nil {
+			session.Stdin = bytes.NewReader(content)
+			err = session.Run("umask 077 && cat > " + path + " && chmod 600 " + path)
+			session.Close()
+		}
+		if err == nil {
+			return true
+		}
+		SSHLogger.Error(fmt.Sprintf("Writing %s failed - %s", path, err))
+		time.Sleep(time.Duration(5 * time.Second))
+	}
+	Logger.Errorf("Writing %s failed %d times. Aborting", path, EXECUTE_RETRY_AMOUNT)
+	return false
+}